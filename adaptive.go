@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// adaptiveLimit bounds the number of concurrent requests AIMD-style:
+// it halves the limit on failure and raises it by one after as many successes as the limit.
+type adaptiveLimit struct {
+	mtx  sync.Mutex
+	cond *sync.Cond
+
+	min, max  int
+	limit     int
+	active    int
+	successes int
+	// generation counts decreases, so a burst of failures of requests started at once decreases only once.
+	generation int
+
+	log io.Writer
+}
+
+func newAdaptiveLimit(min, max int, log io.Writer) *adaptiveLimit {
+	al := &adaptiveLimit{min: min, max: max, limit: max, log: log}
+	al.cond = sync.NewCond(&al.mtx)
+	return al
+}
+
+// acquire waits for a free slot and returns the generation to pass to release.
+func (al *adaptiveLimit) acquire() int {
+	al.mtx.Lock()
+	defer al.mtx.Unlock()
+
+	for al.active >= al.limit {
+		al.cond.Wait()
+	}
+
+	al.active++
+	return al.generation
+}
+
+func (al *adaptiveLimit) release(generation int, ok bool) {
+	al.mtx.Lock()
+	defer al.mtx.Unlock()
+
+	al.active--
+
+	switch {
+	case ok:
+		al.successes++
+		if al.successes >= al.limit && al.limit < al.max {
+			al.setLimit(al.limit + 1)
+		}
+	case generation == al.generation:
+		limit := al.limit / 2
+		if limit < al.min {
+			limit = al.min
+		}
+
+		al.generation++
+		al.setLimit(limit)
+	}
+
+	al.cond.Broadcast()
+}
+
+func (al *adaptiveLimit) setLimit(limit int) {
+	if limit != al.limit && al.log != nil {
+		fmt.Fprintf(al.log, "concurrency %d -> %d\n", al.limit, limit)
+	}
+
+	al.limit = limit
+	al.successes = 0
+}
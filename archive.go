@@ -0,0 +1,216 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// writeTarGz replaces file atomically with a gzipped tarball of bndl's files.
+func writeTarGz(file string, bndl *bundle, modes treeModes) error {
+	tmp := fmt.Sprintf("%s.%d.tmp", file, os.Getpid())
+
+	f, errOp := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if errOp != nil {
+		return errOp
+	}
+
+	if errFA := fillArchive(f, bndl, modes); errFA != nil {
+		f.Close()
+		os.Remove(tmp)
+		return errFA
+	}
+
+	if errCl := f.Close(); errCl != nil {
+		os.Remove(tmp)
+		return errCl
+	}
+
+	if errCO := chownOutput(tmp); errCO != nil {
+		os.Remove(tmp)
+		return errCO
+	}
+
+	return os.Rename(tmp, file)
+}
+
+// fillArchive writes bndl's entries sorted by name, each preceded by its not yet written parent directories.
+func fillArchive(w io.Writer, bndl *bundle, modes treeModes) error {
+	type entry struct {
+		content *string
+		target  string
+	}
+
+	entries := map[string]entry{}
+
+	for name, content := range bndl.Files {
+		content := content
+		entries[name] = entry{content: &content}
+	}
+
+	empty := ""
+	for _, name := range bndl.Empty {
+		entries[name] = entry{content: &empty}
+	}
+
+	for name, target := range bndl.Symlinks {
+		entries[name] = entry{target: target}
+	}
+
+	links := cleanSymlinks(bndl.Symlinks)
+
+	names := make([]string, 0, len(entries))
+	for name := range entries {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	now := time.Now()
+	dirs := map[string]bool{}
+
+	for _, name := range names {
+		// Same checks as for -format dir, relative to an imaginary extraction directory
+		rel, errTP := treePath(".", name)
+		if errTP != nil {
+			return errTP
+		}
+
+		ent := entries[name]
+		if ent.content == nil && !symlinkStaysInside(links, name) {
+			return fmt.Errorf("refusing to archive symlink %s -> %s pointing outside the package", name, ent.target)
+		}
+
+		rel = filepath.ToSlash(rel)
+
+		var parents []string
+		for dir := path.Dir(rel); dir != "." && !dirs[dir]; dir = path.Dir(dir) {
+			parents = append(parents, dir)
+		}
+
+		for i := len(parents) - 1; i >= 0; i-- {
+			dirs[parents[i]] = true
+
+			errWH := tw.WriteHeader(&tar.Header{
+				Typeflag: tar.TypeDir, Name: parents[i] + "/", Mode: int64(modes.dir), ModTime: now,
+			})
+			if errWH != nil {
+				return errWH
+			}
+		}
+
+		if ent.content == nil {
+			errWH := tw.WriteHeader(&tar.Header{
+				Typeflag: tar.TypeSymlink, Name: rel, Linkname: ent.target, Mode: 0777, ModTime: now,
+			})
+			if errWH != nil {
+				return errWH
+			}
+
+			continue
+		}
+
+		errWH := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg, Name: rel, Size: int64(len(*ent.content)), Mode: int64(modes.file), ModTime: now,
+		})
+		if errWH != nil {
+			return errWH
+		}
+
+		if _, errWS := io.Copy(tw, strings.NewReader(*ent.content)); errWS != nil {
+			return errWS
+		}
+	}
+
+	if errCl := tw.Close(); errCl != nil {
+		return errCl
+	}
+
+	return gz.Close()
+}
+
+// archiveAccept asks for a whole stage as (gzipped) tarball, but also accepts the usual file listing.
+const archiveAccept = "application/x-tar, application/gzip, application/json;q=0.5"
+
+type stageArchive struct {
+	contentType string
+	body        []byte
+}
+
+func (sa *stageArchive) isTar() bool {
+	mediaType, _, errPM := mime.ParseMediaType(sa.contentType)
+	if errPM != nil {
+		return false
+	}
+
+	switch mediaType {
+	case "application/x-tar", "application/tar", "application/gzip", "application/x-gzip":
+		return true
+	default:
+		return false
+	}
+}
+
+// untar returns the contents of the tarball's regular files below top-level (like the per-file export).
+func untar(tarball []byte) ([]string, [][]byte, error) {
+	var r io.Reader = bytes.NewReader(tarball)
+
+	if bytes.HasPrefix(tarball, []byte{0x1f, 0x8b}) {
+		gz, errGz := gzip.NewReader(r)
+		if errGz != nil {
+			return nil, nil, errGz
+		}
+
+		r = gz
+	}
+
+	var names []string
+	var contents [][]byte
+	tr := tar.NewReader(r)
+
+	for {
+		hdr, errNx := tr.Next()
+		if errNx == io.EOF {
+			break
+		} else if errNx != nil {
+			return nil, nil, errNx
+		}
+
+		name := strings.TrimPrefix(hdr.Name, "./")
+
+		switch hdr.Typeflag {
+		case tar.TypeReg:
+		case tar.TypeDir:
+			continue
+		default:
+			fmt.Fprintf(os.Stderr, "warning: skipping archived %s of unsupported type %q\n", name, hdr.Typeflag)
+			continue
+		}
+
+		if !strings.Contains(name, "/") {
+			continue
+		}
+
+		content, errRA := ioutil.ReadAll(tr)
+		if errRA != nil {
+			return nil, nil, errRA
+		}
+
+		names = append(names, name)
+		contents = append(contents, content)
+	}
+
+	return names, contents, nil
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+)
+
+type batchProfile struct {
+	connProfile
+	Name        string `json:"name"`
+	OutDir      string `json:"outdir"`
+	PasswordRef string `json:"password-ref"`
+}
+
+type batchRun struct {
+	output   bytes.Buffer
+	err      error
+	packages int
+	files    int
+	bytes    int
+	done     chan struct{}
+}
+
+// batchFlag matches what runBatch must not pass on.
+var batchFlag = regexp.MustCompile(`\A--?(?:batch-(?:file|concurrency)|lockfile|lock-timeout)(=|\z)`)
+
+func readBatch(file string) ([]batchProfile, error) {
+	f, errOp := os.Open(file)
+	if errOp != nil {
+		return nil, errOp
+	}
+
+	defer f.Close()
+
+	var profiles []batchProfile
+	if errDc := json.NewDecoder(bufio.NewReader(f)).Decode(&profiles); errDc != nil {
+		return nil, errDc
+	}
+
+	// Otherwise the profiles' same named PACKAGE.json etc. would overwrite each other.
+	outDirs := map[string]string{}
+
+	for i := range profiles {
+		profile := &profiles[i]
+		if profile.Name == "" {
+			profile.Name = profile.Host
+		}
+
+		if profile.OutDir == "" {
+			profile.OutDir = safeDirName(profile.Name)
+			if profile.OutDir == "" {
+				return nil, fmt.Errorf("profile #%d: outdir missing and the name %q is no directory name", i+1, profile.Name)
+			}
+		}
+
+		outDir := filepath.Clean(profile.OutDir)
+		if other, ok := outDirs[outDir]; ok {
+			return nil, fmt.Errorf("profiles %s and %s share the outdir %s", other, profile.Name, outDir)
+		}
+
+		outDirs[outDir] = profile.Name
+	}
+
+	return profiles, nil
+}
+
+// runBatch exports every profile by running this program once per profile
+// with the profile's connection and the other command line flags.
+func runBatch(file string, concurrency int) {
+	// The latter write one file (or stdout) or git index per run, which the profiles would race on.
+	for _, name := range []string{
+		"host", "port", "ca", "cn", "user", "out-template",
+		"results", "out-single", "combined", "catalog", "cas-dir", "profile", "git-commit", "git-push",
+	} {
+		if isFlagSet(flag.CommandLine, name) {
+			fmt.Fprintf(os.Stderr, "-batch-file and -%s are mutually exclusive\n", name)
+			exit(2)
+		}
+	}
+
+	if concurrency < 1 {
+		fmt.Fprintln(os.Stderr, "-batch-concurrency must be positive")
+		exit(2)
+	}
+
+	profiles, errRB := readBatch(file)
+	if errRB != nil {
+		fmt.Fprintln(os.Stderr, errRB.Error())
+		exit(1)
+	}
+
+	self, errEx := os.Executable()
+	if errEx != nil {
+		fmt.Fprintln(os.Stderr, errEx.Error())
+		exit(1)
+	}
+
+	var shared []string
+	for args := os.Args[1:]; len(args) > 0; args = args[1:] {
+		if match := batchFlag.FindStringSubmatch(args[0]); match != nil {
+			if match[1] == "" && len(args) > 1 {
+				args = args[1:]
+			}
+
+			continue
+		}
+
+		shared = append(shared, args[0])
+	}
+
+	runs := make([]batchRun, len(profiles))
+	for i := range runs {
+		runs[i].done = make(chan struct{})
+	}
+
+	jobs := make(chan int)
+
+	for i := 0; i < concurrency; i++ {
+		go func() {
+			for j := range jobs {
+				runs[j].err = runProfile(self, profiles[j], shared, &runs[j])
+				close(runs[j].done)
+			}
+		}()
+	}
+
+	go func() {
+		for i := range profiles {
+			jobs <- i
+		}
+
+		close(jobs)
+	}()
+
+	failed := 0
+
+	for i := range runs {
+		<-runs[i].done
+		os.Stdout.Write(runs[i].output.Bytes())
+
+		if runs[i].err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", profiles[i].Name, runs[i].err.Error())
+			failed++
+		}
+	}
+
+	var packages, files, bytes int
+
+	for i, run := range runs {
+		if run.err == nil {
+			fmt.Printf("%s: %d packages, %d files, %d bytes\n", profiles[i].Name, run.packages, run.files, run.bytes)
+		} else {
+			fmt.Printf("%s: failed\n", profiles[i].Name)
+		}
+
+		packages += run.packages
+		files += run.files
+		bytes += run.bytes
+	}
+
+	fmt.Printf(
+		"%d of %d profiles exported: %d packages, %d files, %d bytes\n",
+		len(profiles)-failed, len(profiles), packages, files, bytes,
+	)
+
+	if failed > 0 {
+		exit(1)
+	}
+}
+
+func runProfile(self string, profile batchProfile, shared []string, run *batchRun) error {
+	if profile.PasswordRef != "" {
+		profile.PasswordEnv = profile.PasswordRef
+	}
+
+	if profile.PasswordEnv == "" {
+		profile.PasswordEnv = "I2_PASS"
+	}
+
+	if profile.Port == "" {
+		profile.Port = "5665"
+	}
+
+	pass := os.Getenv(profile.PasswordEnv)
+	if pass == "" {
+		return fmt.Errorf("$%s missing", profile.PasswordEnv)
+	}
+
+	results, errTF := ioutil.TempFile("", "i2pkg-results-")
+	if errTF != nil {
+		return errTF
+	}
+
+	results.Close()
+	defer os.Remove(results.Name())
+
+	args := append([]string{
+		"-host", profile.Host, "-port", profile.Port, "-ca", profile.CA, "-cn", profile.CN, "-user", profile.User,
+		"-results", results.Name(), "-checksums-reset",
+	}, shared...)
+
+	args = append(args, "-out-template", profile.OutDir)
+
+	cmd := exec.Command(self, args...)
+	cmd.Env = append(os.Environ(), "I2_PASS="+pass)
+	cmd.Stdout = &run.output
+	cmd.Stderr = &run.output
+
+	if errRn := cmd.Run(); errRn != nil {
+		return errRn
+	}
+
+	content, errRF := ioutil.ReadFile(results.Name())
+	if errRF != nil {
+		return errRF
+	}
+
+	var exported []fileResult
+	if errUJ := json.Unmarshal(content, &exported); errUJ != nil {
+		return errUJ
+	}
+
+	packages := map[string]bool{}
+	for _, file := range exported {
+		packages[file.Package] = true
+		run.files++
+		run.bytes += file.Bytes
+	}
+
+	run.packages = len(packages)
+	return nil
+}
+
+func isFlagSet(fs *flag.FlagSet, name string) bool {
+	set := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+
+	return set
+}
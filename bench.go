@@ -0,0 +1,124 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+func bench(args []string) {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	conn := addConnFlags(fs)
+	pkgName := fs.String("package", "", "`NAME` of the package to download (default: all with an active stage)")
+	iterations := fs.Int("iterations", 3, "download everything `NUMBER` times per concurrency")
+	fileConcurrency := fs.Int("content-max-concurrency-per-package", 1, "`NUMBER` of files to fetch in parallel")
+	output := addOutputFlag(fs)
+	sweep := fs.String("sweep", "", "compare the comma-separated -content-max-concurrency-per-package `NUMBERS`, e.g. 1,2,4,8")
+
+	fs.Parse(args)
+	conn.validate()
+	validateOutput(*output)
+
+	if *iterations < 1 {
+		fmt.Fprintln(os.Stderr, "-iterations must be positive")
+		exit(2)
+	}
+
+	concurrencies := []int{*fileConcurrency}
+	if *sweep != "" {
+		concurrencies = nil
+
+		for _, field := range strings.Split(*sweep, ",") {
+			n, errAt := strconv.Atoi(strings.TrimSpace(field))
+			if errAt != nil || n < 1 {
+				fmt.Fprintf(os.Stderr, "bad -sweep concurrency: %q\n", field)
+				exit(2)
+			}
+
+			concurrencies = append(concurrencies, n)
+		}
+	}
+
+	api := conn.connect().withLog(ioutil.Discard)
+
+	var packages struct {
+		Results []stagedPackage `json:"results"`
+	}
+
+	if errSR := api.sendReq("GET", "/v1/config/packages", nil, &packages); errSR != nil {
+		fmt.Fprintln(os.Stderr, errSR.Error())
+		exit(1)
+	}
+
+	var jobs []stageJob
+	for _, pkg := range packages.Results {
+		if pkg.Name != "" && pkg.ActiveStage != "" && (*pkgName == "" || pkg.Name == *pkgName) {
+			jobs = append(jobs, stageJob{pkg.Name, pkg.ActiveStage})
+		}
+	}
+
+	if len(jobs) < 1 {
+		if *pkgName != "" {
+			fmt.Fprintf(os.Stderr, "no such package with an active stage: %s\n", *pkgName)
+		} else {
+			fmt.Fprintln(os.Stderr, "no packages with an active stage")
+		}
+
+		exit(1)
+	}
+
+	type benchRow struct {
+		Concurrency    int     `json:"concurrency"`
+		Files          int     `json:"files"`
+		Bytes          int     `json:"bytes"`
+		Seconds        float64 `json:"seconds"`
+		FilesPerSecond float64 `json:"files-per-second"`
+		BytesPerSecond float64 `json:"bytes-per-second"`
+	}
+
+	rows := make([]benchRow, 0, len(concurrencies))
+
+	for _, concurrency := range concurrencies {
+		exp := &exporter{api: api, fileConcurrency: concurrency, checksumAlgo: "sha256"}
+		files, bytes := 0, 0
+		start := time.Now()
+
+		for i := 0; i < *iterations; i++ {
+			for _, job := range jobs {
+				bndl, errFt := exp.fetch(job, ioutil.Discard)
+				if errFt != nil {
+					fmt.Fprintln(os.Stderr, errFt.Error())
+					exit(1)
+				}
+
+				files += len(bndl.Files)
+				for _, content := range bndl.Files {
+					bytes += len(content)
+				}
+			}
+		}
+
+		seconds := time.Since(start).Seconds()
+		rows = append(rows, benchRow{concurrency, files, bytes, seconds, float64(files) / seconds, float64(bytes) / seconds})
+	}
+
+	render(*output, rows, func(w io.Writer) {
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+		fmt.Fprintln(tw, "CONCURRENCY\tFILES\tBYTES\tSECONDS\tFILES/S\tBYTES/S\t")
+
+		for _, row := range rows {
+			fmt.Fprintf(
+				tw, "%d\t%d\t%d\t%.2f\t%.1f\t%.0f\t\n",
+				row.Concurrency, row.Files, row.Bytes, row.Seconds, row.FilesPerSecond, row.BytesPerSecond,
+			)
+		}
+
+		tw.Flush()
+	})
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func benchmarkExportFetch(b *testing.B, files, concurrency int) {
+	job := stageJob{"bench", "stage-1"}
+	exp := &exporter{
+		api:             newTestAPI(b, newMockMaster(job, files), ioutil.Discard),
+		fileConcurrency: concurrency, checksumAlgo: "sha256",
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, errFt := exp.fetch(job, ioutil.Discard); errFt != nil {
+			b.Fatal(errFt)
+		}
+	}
+}
+
+func BenchmarkExportFetch100(b *testing.B) {
+	benchmarkExportFetch(b, 100, 1)
+}
+
+func BenchmarkExportFetch100Concurrency8(b *testing.B) {
+	benchmarkExportFetch(b, 100, 8)
+}
+
+func BenchmarkExportFetch1000Concurrency32(b *testing.B) {
+	benchmarkExportFetch(b, 1000, 32)
+}
+
+// BenchmarkExportJSON measures a whole package's export, i.e. fetching and writing it.
+func BenchmarkExportJSON(b *testing.B) {
+	dir, errTD := ioutil.TempDir("", "i2pkg-bench-")
+	if errTD != nil {
+		b.Fatal(errTD)
+	}
+
+	defer os.RemoveAll(dir)
+
+	job := stageJob{"bench", "stage-1"}
+	exp := &exporter{
+		api:             newTestAPI(b, newMockMaster(job, 100), ioutil.Discard),
+		fileConcurrency: 8, checksumAlgo: "sha256", outDir: dir, formats: []string{"json"}, encode: "raw",
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		res := &exportResult{}
+
+		bndl, errFt := exp.fetch(job, ioutil.Discard)
+		if errFt != nil {
+			b.Fatal(errFt)
+		}
+
+		res.bundle = bndl
+		exp.finish(job, res)
+	}
+
+	b.StopTimer()
+
+	if _, errSt := os.Stat(filepath.Join(dir, "bench.json")); errSt != nil {
+		b.Fatal(errSt)
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A -cas-dir content-addressed store looks like this:
+//
+//	objects/ab/cdef...       every distinct file content once, named by its SHA-256 (hex, split after two digits)
+//	manifests/TIME.json      one casManifest per export, TIME like 20060102T150405Z
+//
+// Objects are never changed or deleted, so exports may share them.
+type casStore struct {
+	dir      string
+	mtx      sync.Mutex
+	manifest casManifest
+}
+
+type casManifest struct {
+	Host     string               `json:"host"`
+	Exported string               `json:"exported"`
+	Packages map[string]*casEntry `json:"packages"`
+}
+
+type casEntry struct {
+	Stage string `json:"stage"`
+	// file names to the SHA-256 of their content
+	Files    map[string]string `json:"files"`
+	Symlinks map[string]string `json:"symlinks,omitempty"`
+	Meta     *bundleMeta       `json:"meta,omitempty"`
+	Inactive bool              `json:"inactive,omitempty"`
+}
+
+func newCASStore(dir, host string, exported time.Time) (*casStore, error) {
+	for _, sub := range []string{"objects", "manifests"} {
+		if errMA := os.MkdirAll(filepath.Join(dir, sub), 0755); errMA != nil {
+			return nil, errMA
+		}
+	}
+
+	return &casStore{dir: dir, manifest: casManifest{
+		Host: host, Exported: exported.UTC().Format(time.RFC3339), Packages: map[string]*casEntry{},
+	}}, nil
+}
+
+func (cs *casStore) objectPath(sum string) string {
+	return filepath.Join(cs.dir, "objects", sum[:2], sum[2:])
+}
+
+// add stores bndl's (name's) file contents not in the store yet and records them in the manifest.
+func (cs *casStore) add(name, stage string, bndl *bundle) error {
+	entry := &casEntry{
+		Stage: stage, Files: map[string]string{}, Symlinks: bndl.Symlinks, Meta: bndl.Meta, Inactive: bndl.Inactive,
+	}
+
+	contents := map[string]string{}
+	for file, content := range bndl.Files {
+		contents[file] = content
+	}
+
+	for _, file := range bndl.Empty {
+		contents[file] = ""
+	}
+
+	for file, content := range contents {
+		raw := sha256.Sum256([]byte(content))
+		sum := hex.EncodeToString(raw[:])
+
+		if errPO := cs.putObject(sum, content); errPO != nil {
+			return errPO
+		}
+
+		entry.Files[file] = sum
+	}
+
+	cs.mtx.Lock()
+	cs.manifest.Packages[name] = entry
+	cs.mtx.Unlock()
+
+	return nil
+}
+
+func (cs *casStore) putObject(sum, content string) error {
+	path := cs.objectPath(sum)
+	if _, errSt := os.Stat(path); errSt == nil {
+		return nil
+	}
+
+	dir := filepath.Dir(path)
+	if errMA := os.MkdirAll(dir, 0755); errMA != nil {
+		return errMA
+	}
+
+	// Unlike PATH.PID.tmp, unique even if two packages share a new object.
+	f, errTF := ioutil.TempFile(dir, ".tmp-")
+	if errTF != nil {
+		return errTF
+	}
+
+	if _, errWS := f.WriteString(content); errWS != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return errWS
+	}
+
+	if errCl := f.Close(); errCl != nil {
+		os.Remove(f.Name())
+		return errCl
+	}
+
+	if errCO := chownOutput(f.Name()); errCO != nil {
+		os.Remove(f.Name())
+		return errCO
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+// close writes the manifest and returns its path.
+func (cs *casStore) close(exported time.Time) (string, error) {
+	path := filepath.Join(cs.dir, "manifests", exported.UTC().Format("20060102T150405Z")+".json")
+	return path, writeJSON(path, &cs.manifest, false)
+}
+
+// casRestore turns a -cas-dir manifest back into PACKAGE.json bundles for import.
+func casRestore(args []string) {
+	fs := flag.NewFlagSet("cas-restore", flag.ExitOnError)
+	casDir := fs.String("cas-dir", "", "content-addressed store `DIRECTORY` of an export with -cas-dir")
+	manifestFile := fs.String("manifest", "", "manifest `FILE` (default: the newest one in -cas-dir)")
+	outDir := fs.String("out-dir", ".", "write the PACKAGE.json files into `DIRECTORY`")
+
+	fs.Parse(args)
+
+	if *casDir == "" {
+		fmt.Fprintln(os.Stderr, "-cas-dir missing")
+		exit(2)
+	}
+
+	if *manifestFile == "" {
+		manifests, errGl := filepath.Glob(filepath.Join(*casDir, "manifests", "*.json"))
+		if errGl != nil || len(manifests) < 1 {
+			fmt.Fprintf(os.Stderr, "no manifests in %s\n", *casDir)
+			exit(1)
+		}
+
+		// Their names sort by time.
+		sort.Strings(manifests)
+		*manifestFile = manifests[len(manifests)-1]
+	}
+
+	var manifest casManifest
+	{
+		raw, errRF := ioutil.ReadFile(*manifestFile)
+		if errRF != nil {
+			fmt.Fprintln(os.Stderr, errRF.Error())
+			exit(1)
+		}
+
+		if errUm := json.Unmarshal(raw, &manifest); errUm != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", *manifestFile, errUm.Error())
+			exit(1)
+		}
+	}
+
+	if errMA := os.MkdirAll(*outDir, 0755); errMA != nil {
+		fmt.Fprintln(os.Stderr, errMA.Error())
+		exit(1)
+	}
+
+	cs := &casStore{dir: *casDir}
+
+	var names []string
+	for name := range manifest.Packages {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		entry := manifest.Packages[name]
+		bndl := &bundle{
+			FormatVersion: bundleFormatVersion, Files: map[string]string{},
+			Symlinks: entry.Symlinks, Meta: entry.Meta, Inactive: entry.Inactive,
+		}
+
+		for file, sum := range entry.Files {
+			if _, errDS := hex.DecodeString(sum); errDS != nil || len(sum) != 2*sha256.Size {
+				fmt.Fprintf(os.Stderr, "%s: %s: bad SHA-256 %q in manifest\n", name, file, sum)
+				exit(1)
+			}
+
+			content, errRF := ioutil.ReadFile(cs.objectPath(sum))
+			if errRF != nil {
+				fmt.Fprintf(os.Stderr, "%s: %s: %s\n", name, file, errRF.Error())
+				exit(1)
+			}
+
+			if raw := sha256.Sum256(content); hex.EncodeToString(raw[:]) != sum {
+				fmt.Fprintf(os.Stderr, "%s: %s: object %s is corrupt\n", name, file, sum)
+				exit(1)
+			}
+
+			bndl.Files[file] = string(content)
+		}
+
+		path := filepath.Join(*outDir, bundleFile(name))
+		if errWJ := writeJSON(path, bndl, false); errWJ != nil {
+			fmt.Fprintln(os.Stderr, errWJ.Error())
+			exit(1)
+		}
+
+		fmt.Printf("%s: %d files from stage %s written to %s\n", name, len(bndl.Files), entry.Stage, path)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+func catFile(args []string) {
+	fs := flag.NewFlagSet("cat", flag.ExitOnError)
+	conn := addConnFlags(fs)
+	pkgName := fs.String("package", "", "`NAME` of the package")
+	stage := fs.String("stage", "", "`NAME` of the stage (default: the active one)")
+	file := fs.String("file", "", "`PATH` of the file inside the stage")
+
+	fs.Parse(args)
+	conn.validate()
+
+	for _, flg := range []struct {
+		name  string
+		value string
+	}{{"package", *pkgName}, {"file", *file}} {
+		if flg.value == "" {
+			fmt.Fprintf(os.Stderr, "-%s missing\n", flg.name)
+			exit(2)
+		}
+	}
+
+	api := conn.connect().withLog(os.Stderr)
+
+	if *stage == "" {
+		var packages struct {
+			Results []stagedPackage `json:"results"`
+		}
+
+		if errSR := api.sendReq("GET", "/v1/config/packages", nil, &packages); errSR != nil {
+			fmt.Fprintln(os.Stderr, errSR.Error())
+			exit(1)
+		}
+
+		for _, pkg := range packages.Results {
+			if pkg.Name == *pkgName {
+				*stage = pkg.ActiveStage
+				if *stage == "" {
+					fmt.Fprintf(os.Stderr, "package %s has no active stage\n", *pkgName)
+					exit(1)
+				}
+
+				break
+			}
+		}
+
+		if *stage == "" {
+			fmt.Fprintf(os.Stderr, "no such package: %s\n", *pkgName)
+			exit(1)
+		}
+	}
+
+	var content []byte
+	if errSR := api.sendReq("GET", fileURI(*pkgName, *stage, *file, false), nil, &content); errSR != nil {
+		if bhs, ok := errSR.(badHttpStatus); ok && bhs.code == http.StatusNotFound {
+			fmt.Fprintf(os.Stderr, "no such file: %s/%s/%s\n", *pkgName, *stage, *file)
+		} else {
+			fmt.Fprintln(os.Stderr, errSR.Error())
+		}
+
+		exit(1)
+	}
+
+	if _, errWr := os.Stdout.Write(content); errWr != nil {
+		fmt.Fprintln(os.Stderr, errWr.Error())
+		exit(1)
+	}
+}
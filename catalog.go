@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// catalog is what -catalog writes, e.g. for an inventory of several masters.
+type catalog struct {
+	Host      string         `json:"host"`
+	Generated string         `json:"generated"`
+	Packages  []catalogEntry `json:"packages"`
+}
+
+type catalogEntry struct {
+	Package     string      `json:"package"`
+	ActiveStage string      `json:"active-stage"`
+	Stages      []stageInfo `json:"stages"`
+}
+
+// writeCatalog writes the catalog of packages (only the listed ones, if not nil) into path.
+func writeCatalog(api *apiClient, packages []stagedPackage, listed map[string]bool, host, path string, escapeHTML bool) {
+	cat := catalog{Host: host, Generated: time.Now().UTC().Format(time.RFC3339), Packages: []catalogEntry{}}
+
+	for i := range packages {
+		pkg := &packages[i]
+		if pkg.Name == "" || listed != nil && !listed[pkg.Name] {
+			continue
+		}
+
+		infos, errSI := stageInfos(api, pkg)
+		if errSI != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", pkg.Name, errSI.Error())
+			exit(1)
+		}
+
+		cat.Packages = append(cat.Packages, catalogEntry{pkg.Name, pkg.ActiveStage, infos})
+	}
+
+	sort.Slice(cat.Packages, func(i, j int) bool {
+		return cat.Packages[i].Package < cat.Packages[j].Package
+	})
+
+	if errWJ := writeJSON(path, &cat, escapeHTML); errWJ != nil {
+		fmt.Fprintln(os.Stderr, errWJ.Error())
+		exit(1)
+	}
+}
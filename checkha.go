@@ -0,0 +1,222 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"text/tabwriter"
+)
+
+type haProbe struct {
+	err      error
+	version  string
+	packages []string
+}
+
+func checkHA(args []string) {
+	fs := flag.NewFlagSet("check-ha", flag.ExitOnError)
+	var hosts stringList
+	fs.Var(&hosts, "host", "`HOST` of a master (repeatable)")
+	port := fs.String("port", "5665", "PORT")
+	ca := fs.String("ca", "", caUsage)
+	cn := fs.String("cn", "", "COMMON_NAME of all masters (default: each -host)")
+	user := fs.String("user", "", "USERNAME")
+	client := addClientFlags(fs)
+	output := addOutputFlag(fs)
+
+	fs.Parse(args)
+	validateOutput(*output)
+
+	if len(hosts) < 2 {
+		fmt.Fprintln(os.Stderr, "at least two -host required")
+		exit(2)
+	}
+
+	if *ca == "" {
+		*ca = os.Getenv("I2_CA")
+	}
+
+	if *ca == "" {
+		fmt.Fprintln(os.Stderr, "-ca missing")
+		exit(2)
+	}
+
+	if *user == "" && *client.tokenFile == "" {
+		fmt.Fprintln(os.Stderr, "-user missing")
+		exit(2)
+	}
+
+	pass := os.Getenv("I2_PASS")
+	if pass == "" && *client.tokenFile == "" {
+		fmt.Fprintln(os.Stderr, "$I2_PASS missing")
+		exit(2)
+	}
+
+	probes := make([]haProbe, len(hosts))
+	var wg sync.WaitGroup
+
+	for i, host := range hosts {
+		wg.Add(1)
+
+		go func(probe *haProbe, host string) {
+			defer wg.Done()
+
+			hostCN := *cn
+			if hostCN == "" {
+				hostCN = hostName(host)
+			}
+
+			api, errNC := newAPIClient(host, *port, *ca, hostCN, *user, pass, client.options())
+			if errNC != nil {
+				probe.err = errNC
+				return
+			}
+
+			probe.version, probe.packages, probe.err = probeMaster(api.withLog(os.Stderr))
+		}(&probes[i], host)
+	}
+
+	wg.Wait()
+
+	type master struct {
+		Host     string `json:"host"`
+		Status   string `json:"status"`
+		Version  string `json:"version,omitempty"`
+		Packages int    `json:"packages"`
+		Error    string `json:"error,omitempty"`
+	}
+
+	type disagreement struct {
+		Host      string   `json:"host"`
+		Reference string   `json:"reference"`
+		Missing   []string `json:"missing"`
+		Extra     []string `json:"extra"`
+	}
+
+	report := struct {
+		Masters       []master       `json:"masters"`
+		Disagreements []disagreement `json:"disagreements"`
+	}{[]master{}, []disagreement{}}
+
+	failed := false
+
+	for i, probe := range probes {
+		if probe.err != nil {
+			report.Masters = append(report.Masters, master{Host: hosts[i], Status: "unreachable", Error: probe.err.Error()})
+			fmt.Fprintf(os.Stderr, "%s: %s\n", hosts[i], probe.err.Error())
+			failed = true
+			continue
+		}
+
+		report.Masters = append(report.Masters, master{
+			Host: hosts[i], Status: "ok", Version: probe.version, Packages: len(probe.packages),
+		})
+	}
+
+	// Compare every reachable master with the first reachable one.
+	var reference *haProbe
+	var referenceHost string
+
+	for i := range probes {
+		probe := &probes[i]
+		if probe.err != nil {
+			continue
+		}
+
+		if reference == nil {
+			reference, referenceHost = probe, hosts[i]
+			continue
+		}
+
+		if missing, extra := diffNames(reference.packages, probe.packages); len(missing) > 0 || len(extra) > 0 {
+			report.Disagreements = append(report.Disagreements, disagreement{
+				hosts[i], referenceHost, append([]string{}, missing...), append([]string{}, extra...),
+			})
+			failed = true
+		}
+	}
+
+	render(*output, report, func(w io.Writer) {
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "HOST\tSTATUS\tVERSION\tPACKAGES")
+
+		for _, m := range report.Masters {
+			if m.Status != "ok" {
+				fmt.Fprintf(tw, "%s\t%s\t-\t-\n", m.Host, m.Status)
+			} else {
+				fmt.Fprintf(tw, "%s\t%s\t%s\t%d\n", m.Host, m.Status, m.Version, m.Packages)
+			}
+		}
+
+		tw.Flush()
+
+		for _, d := range report.Disagreements {
+			fmt.Fprintf(w, "%s disagrees with %s on packages:", d.Host, d.Reference)
+
+			for _, name := range d.Missing {
+				fmt.Fprintf(w, " -%s", name)
+			}
+
+			for _, name := range d.Extra {
+				fmt.Fprintf(w, " +%s", name)
+			}
+
+			fmt.Fprintln(w)
+		}
+	})
+
+	if failed {
+		exit(1)
+	}
+}
+
+func probeMaster(api *apiClient) (string, []string, error) {
+	var info apiInfo
+
+	if errSR := api.sendReq("GET", "/v1", nil, &info); errSR != nil {
+		return "", nil, errSR
+	}
+
+	version := ""
+	if len(info.Results) > 0 {
+		version = info.Results[0].Version
+	}
+
+	var packages struct {
+		Results []stagedPackage `json:"results"`
+	}
+
+	if errSR := api.sendReq("GET", "/v1/config/packages", nil, &packages); errSR != nil {
+		return "", nil, errSR
+	}
+
+	names := make([]string, 0, len(packages.Results))
+	for _, pkg := range packages.Results {
+		names = append(names, pkg.Name)
+	}
+
+	sort.Strings(names)
+	return version, names, nil
+}
+
+// diffNames returns the names of sorted a missing in sorted b and vice versa.
+func diffNames(a, b []string) ([]string, []string) {
+	var missing, extra []string
+	for len(a) > 0 || len(b) > 0 {
+		switch {
+		case len(b) < 1 || len(a) > 0 && a[0] < b[0]:
+			missing = append(missing, a[0])
+			a = a[1:]
+		case len(a) < 1 || b[0] < a[0]:
+			extra = append(extra, b[0])
+			b = b[1:]
+		default:
+			a, b = a[1:], b[1:]
+		}
+	}
+
+	return missing, extra
+}
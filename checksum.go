@@ -0,0 +1,35 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+)
+
+// checksumAlgos maps -checksum-algo values to hash functions.
+var checksumAlgos = map[string]func() hash.Hash{"sha256": sha256.New, "sha512": sha512.New}
+
+// fileChecksum records a file's hash under the key of the algorithm used.
+type fileChecksum struct {
+	Sha256 string `json:"sha256,omitempty"`
+	Sha512 string `json:"sha512,omitempty"`
+}
+
+// newChecksum hashes content with algo, sha256 if empty.
+func newChecksum(algo string, content []byte) fileChecksum {
+	newHash, ok := checksumAlgos[algo]
+	if !ok {
+		newHash = sha256.New
+	}
+
+	h := newHash()
+	h.Write(content)
+	sum := fmt.Sprintf("%x", h.Sum(nil))
+
+	if algo == "sha512" {
+		return fileChecksum{Sha512: sum}
+	}
+
+	return fileChecksum{Sha256: sum}
+}
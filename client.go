@@ -0,0 +1,1100 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type httpLogger struct {
+	next http.RoundTripper
+	// also log the protocol of each new connection
+	protocols bool
+}
+
+var _ http.RoundTripper = httpLogger{}
+
+func (hl httpLogger) RoundTrip(request *http.Request) (*http.Response, error) {
+	log := requestLog(request)
+	fmt.Fprintf(log, "%s %s\n", request.Method, withoutUserinfo(request.URL))
+
+	if !hl.protocols {
+		return hl.next.RoundTrip(request)
+	}
+
+	var conn *httptrace.GotConnInfo
+	request = request.WithContext(httptrace.WithClientTrace(request.Context(), &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			conn = &info
+		},
+	}))
+
+	response, errRT := hl.next.RoundTrip(request)
+	if errRT == nil && conn != nil && !conn.Reused {
+		fmt.Fprintf(
+			log, "new connection %s -> %s speaks %s\n", conn.Conn.LocalAddr(), conn.Conn.RemoteAddr(), response.Proto,
+		)
+	}
+
+	return response, errRT
+}
+
+// withoutUserinfo formats u without any credentials in it.
+func withoutUserinfo(u *url.URL) string {
+	if u.User == nil {
+		return u.String()
+	}
+
+	clone := *u
+	clone.User = nil
+	return clone.String()
+}
+
+// withoutURLUserinfo is withoutUserinfo for s if it's a URL.
+func withoutURLUserinfo(s string) string {
+	if u, errPs := url.Parse(s); errPs == nil && u.User != nil {
+		return withoutUserinfo(u)
+	}
+
+	return s
+}
+
+func requestLog(request *http.Request) io.Writer {
+	if log, ok := request.Context().Value(logTo{}).(io.Writer); ok {
+		return log
+	}
+
+	return os.Stdout
+}
+
+type closableReader struct {
+	r io.Reader
+}
+
+var _ io.ReadCloser = closableReader{}
+
+func (cr closableReader) Read(p []byte) (int, error) {
+	return cr.r.Read(p)
+}
+
+func (closableReader) Close() error {
+	return nil
+}
+
+type badHttpStatus struct {
+	code int
+	// Icinga 2's error message, if any
+	status string
+}
+
+var _ error = badHttpStatus{}
+
+func (bhs badHttpStatus) Error() string {
+	switch bhs.code {
+	case http.StatusUnauthorized:
+		return "HTTP 401 (bad credentials)"
+	case http.StatusForbidden:
+		return "HTTP 403 (permission denied)"
+	default:
+		return fmt.Sprintf("HTTP %d", bhs.code)
+	}
+}
+
+// errorStatus extracts the message from an Icinga 2 error response, either {"status": ...}
+// or (per object, e.g. package) {"results": [{"status": ...}]}.
+func errorStatus(body []byte) string {
+	var response struct {
+		Status  string `json:"status"`
+		Results []struct {
+			Status string `json:"status"`
+		} `json:"results"`
+	}
+
+	if json.Unmarshal(body, &response) != nil {
+		return ""
+	}
+
+	if response.Status == "" && len(response.Results) > 0 {
+		return response.Results[0].Status
+	}
+
+	return response.Status
+}
+
+type logTo struct{}
+
+// fileRequest marks requests downloading file content (see -timeout-per-file).
+type fileRequest struct{}
+
+type responseTooLarge struct {
+	uri   string
+	limit int64
+}
+
+var _ error = responseTooLarge{}
+
+func (rtl responseTooLarge) Error() string {
+	return fmt.Sprintf("%s: response exceeds %d bytes", rtl.uri, rtl.limit)
+}
+
+type connFlags struct {
+	host   *string
+	port   *string
+	ca     *string
+	cn     *string
+	user   *string
+	client clientFlags
+}
+
+func addConnFlags(fs *flag.FlagSet) connFlags {
+	return connFlags{
+		host:   fs.String("host", "", "HOST"),
+		port:   fs.String("port", "5665", "PORT"),
+		ca:     fs.String("ca", "", caUsage),
+		cn:     fs.String("cn", "", "COMMON_NAME (default: -host)"),
+		user:   fs.String("user", "", "USERNAME"),
+		client: addClientFlags(fs),
+	}
+}
+
+type clientFlags struct {
+	maxResponseSize *int64
+	signCommand     *string
+	retryBudget     *time.Duration
+	connectTimeout  *time.Duration
+	timeout         *time.Duration
+	fileTimeout     *time.Duration
+	insecureHosts   *stringList
+	strictJSON      *bool
+	skipHostname    *bool
+	adaptiveMin     *int
+	adaptiveMax     *int
+	verbose         *bool
+	acceptStatus    *statusList
+	sessionCache    *bool
+	retryDecode     *bool
+	tcpKeepAlive    *time.Duration
+	maxRedirects    *int
+	crossHostAuth   *bool
+	protocolLog     *bool
+	tokenFile       *string
+	tokenRefresh    *bool
+	verifyExpiry    *bool
+	expiryWarn      *time.Duration
+}
+
+// statusList is a comma-separated list of HTTP status codes.
+type statusList []int
+
+var _ flag.Value = (*statusList)(nil)
+
+func (sl *statusList) String() string {
+	codes := make([]string, 0, len(*sl))
+	for _, code := range *sl {
+		codes = append(codes, strconv.Itoa(code))
+	}
+
+	return strings.Join(codes, ",")
+}
+
+func (sl *statusList) Set(s string) error {
+	var codes statusList
+	for _, code := range strings.Split(s, ",") {
+		i, errAt := strconv.Atoi(strings.TrimSpace(code))
+		if errAt != nil || i < 100 || i > 599 {
+			return fmt.Errorf("bad HTTP status code: %q", code)
+		}
+
+		codes = append(codes, i)
+	}
+
+	*sl = codes
+	return nil
+}
+
+func addClientFlags(fs *flag.FlagSet) clientFlags {
+	var insecureHosts stringList
+	fs.Var(&insecureHosts, "insecure-host", "don't verify the TLS certificate of `HOST` (repeatable)")
+
+	var acceptStatus statusList
+	fs.Var(&acceptStatus, "accept-status", "treat only the comma-separated HTTP status `CODES` as success (default: any 2xx)")
+
+	return clientFlags{
+		maxResponseSize: fs.Int64("max-response-size", 0, "refuse to decode JSON responses larger than `BYTES` (0: unlimited)"),
+		signCommand: fs.String(
+			"sign-command", "",
+			"run `COMMAND` with method and request URI as extra arguments and body as stdin per request, "+
+				"add the \"Name: value\" lines it prints as headers",
+		),
+		retryBudget: fs.Duration(
+			"retry-budget", time.Minute, "wait at most `DURATION` in total per request for a rate-limiting (HTTP 429) master",
+		),
+		connectTimeout: fs.Duration(
+			"connect-timeout", 30*time.Second, "give up connecting to the master after `DURATION` (0: never)",
+		),
+		tcpKeepAlive: fs.Duration(
+			"tcp-keepalive", 30*time.Second,
+			"send TCP keep-alive probes every `DURATION` to keep NAT/firewall mappings of idle connections (negative: don't)",
+		),
+		timeout: fs.Duration(
+			"timeout", 0,
+			"give up a request incl. connecting and reading the response after `DURATION` (0: never) - "+
+				"keep it above -connect-timeout to allow slow downloads from masters that are up",
+		),
+		fileTimeout: fs.Duration(
+			"timeout-per-file", 0,
+			"like -timeout, but for downloading a file's content or a stage's archive (0: same as -timeout), "+
+				"so -timeout can be strict on package and file listings",
+		),
+		insecureHosts: &insecureHosts,
+		acceptStatus:  &acceptStatus,
+		skipHostname:  fs.Bool("skip-hostname-verify", false, "verify the master's certificate chain, but not whether it's issued for -cn"),
+		adaptiveMin:   fs.Int("adaptive-min", 1, "don't let -adaptive-max shrink below `NUMBER`"),
+		adaptiveMax: fs.Int(
+			"adaptive-max", 0,
+			"send at most `NUMBER` requests at once (0: unlimited), halve that on HTTP 429/5xx and raise it again on success",
+		),
+		verbose:    fs.Bool("verbose", false, "log details like -adaptive-max changes or -exclude-file-glob matches"),
+		strictJSON: fs.Bool("strict-json", false, "fail on fields in JSON responses this program doesn't know (API schema drift)"),
+		sessionCache: fs.Bool(
+			"tls-session-cache", true,
+			"resume TLS sessions instead of full handshakes on new connections (-tls-session-cache=false for strict environments)",
+		),
+		retryDecode: fs.Bool(
+			"retry-decode-errors", false,
+			"repeat requests (within -retry-budget) whose responses aren't valid JSON, e.g. truncated by a proxy (-verbose logs them)",
+		),
+		maxRedirects: fs.Int("max-redirects", 10, "follow at most `NUMBER` HTTP redirects per request"),
+		crossHostAuth: fs.Bool(
+			"allow-cross-host-auth", false, "send the API credentials also along redirects to other hosts (or ports)",
+		),
+		protocolLog: fs.Bool(
+			"http-version-log", false, "log the HTTP version (e.g. HTTP/2.0) negotiated on each new connection (implied by -verbose)",
+		),
+		tokenFile: fs.String(
+			"token-file", "",
+			"authenticate with the bearer token in `FILE` (e.g. a Kubernetes service account's) instead of -user and $I2_PASS",
+		),
+		tokenRefresh: fs.Bool("token-file-refresh", false, "re-read -token-file for every request as such tokens rotate"),
+		verifyExpiry: fs.Bool(
+			"verify-cert-expiry", false, "warn if the master's TLS certificate expires within -cert-expiry-warn (never fails)",
+		),
+		expiryWarn: fs.Duration("cert-expiry-warn", 14*24*time.Hour, "-verify-cert-expiry's `DURATION`"),
+	}
+}
+
+type clientOptions struct {
+	maxResponseSize int64
+	signCommand     []string
+	retryBudget     time.Duration
+	connectTimeout  time.Duration
+	timeout         time.Duration
+	fileTimeout     time.Duration
+	insecureHosts   map[string]bool
+	strictJSON      bool
+	skipHostname    bool
+	adaptiveMin     int
+	adaptiveMax     int
+	verbose         bool
+	acceptStatus    []int
+	sessionCache    bool
+	retryDecode     bool
+	tcpKeepAlive    time.Duration
+	maxRedirects    int
+	crossHostAuth   bool
+	protocolLog     bool
+	tokenFile       string
+	tokenRefresh    bool
+	// warn if the master's certificate expires within that (0: don't check)
+	expiryWarn time.Duration
+}
+
+func (co *clientOptions) success(status int) bool {
+	if len(co.acceptStatus) < 1 {
+		return status >= 200 && status < 300
+	}
+
+	for _, code := range co.acceptStatus {
+		if status == code {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (cf clientFlags) options() clientOptions {
+	// Not in connFlags.validate, the subcommands with several masters don't call it.
+	if *cf.tokenRefresh && *cf.tokenFile == "" {
+		fmt.Fprintln(os.Stderr, "-token-file-refresh requires -token-file")
+		exit(2)
+	}
+
+	opts := clientOptions{
+		maxResponseSize: *cf.maxResponseSize,
+		signCommand:     strings.Fields(*cf.signCommand),
+		retryBudget:     *cf.retryBudget,
+		connectTimeout:  *cf.connectTimeout,
+		timeout:         *cf.timeout,
+		fileTimeout:     *cf.fileTimeout,
+		insecureHosts:   map[string]bool{},
+		strictJSON:      *cf.strictJSON,
+		skipHostname:    *cf.skipHostname,
+		adaptiveMin:     *cf.adaptiveMin,
+		adaptiveMax:     *cf.adaptiveMax,
+		verbose:         *cf.verbose,
+		acceptStatus:    *cf.acceptStatus,
+		sessionCache:    *cf.sessionCache,
+		retryDecode:     *cf.retryDecode,
+		tcpKeepAlive:    *cf.tcpKeepAlive,
+		maxRedirects:    *cf.maxRedirects,
+		crossHostAuth:   *cf.crossHostAuth,
+		protocolLog:     *cf.protocolLog,
+		tokenFile:       *cf.tokenFile,
+		tokenRefresh:    *cf.tokenRefresh,
+	}
+
+	if *cf.verifyExpiry {
+		opts.expiryWarn = *cf.expiryWarn
+	}
+
+	for _, host := range *cf.insecureHosts {
+		opts.insecureHosts[host] = true
+	}
+
+	return opts
+}
+
+func (cf connFlags) validate() {
+	if *cf.host == "" {
+		fmt.Fprintln(os.Stderr, "-host missing")
+		exit(2)
+	}
+
+	if *cf.port == "" {
+		fmt.Fprintln(os.Stderr, "-port missing")
+		exit(2)
+	}
+
+	if *cf.ca == "" {
+		*cf.ca = os.Getenv("I2_CA")
+	}
+
+	if *cf.ca == "" {
+		fmt.Fprintln(os.Stderr, "-ca missing")
+		exit(2)
+	}
+
+	if *cf.cn == "" {
+		*cf.cn = hostName(*cf.host)
+	}
+
+	if *cf.user == "" && *cf.client.tokenFile == "" {
+		fmt.Fprintln(os.Stderr, "-user missing")
+		exit(2)
+	}
+}
+
+// hostName strips a port and IPv6 brackets from host, e.g. to use it as -cn.
+func hostName(host string) string {
+	if name, _, errSH := net.SplitHostPort(host); errSH == nil {
+		return name
+	}
+
+	return strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+}
+
+type apiClient struct {
+	client *http.Client
+	// client with -timeout-per-file
+	fileClient *http.Client
+	base       *http.Request
+	opts       clientOptions
+	limiter    *adaptiveLimit
+}
+
+func (cf connFlags) connect() *apiClient {
+	pass := os.Getenv("I2_PASS")
+	if pass == "" && *cf.client.tokenFile == "" {
+		fmt.Fprintln(os.Stderr, "$I2_PASS missing")
+		exit(2)
+	}
+
+	ac, errNC := newAPIClient(*cf.host, *cf.port, *cf.ca, *cf.cn, *cf.user, pass, cf.client.options())
+	if errNC != nil {
+		fmt.Fprintln(os.Stderr, errNC.Error())
+		exit(1)
+	}
+
+	return ac
+}
+
+func newAPIClient(host, port, ca, cn, user, pass string, opts clientOptions) (*apiClient, error) {
+	var cas *x509.CertPool
+
+	{
+		pem, errLC := loadCA(ca)
+		if errLC != nil {
+			return nil, errLC
+		}
+
+		pool, errPC := parseCAs(pem)
+		if errPC != nil {
+			if inlinePEM(ca) {
+				ca = "-ca"
+			}
+
+			return nil, fmt.Errorf("%s: %s", withoutURLUserinfo(ca), errPC.Error())
+		}
+
+		cas = pool
+	}
+
+	tlsConfig := &tls.Config{RootCAs: cas, ServerName: cn}
+	if opts.sessionCache {
+		tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+	}
+
+	switch {
+	case opts.insecureHosts[host]:
+		fmt.Fprintf(os.Stderr, "warning: not verifying the TLS certificate of %s\n", host)
+		tlsConfig.InsecureSkipVerify = true
+	case opts.skipHostname:
+		fmt.Fprintf(os.Stderr, "warning: not verifying whether the TLS certificate of %s is issued for %s\n", host, cn)
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyPeerCertificate = verifyChain(cas)
+	}
+
+	if opts.expiryWarn > 0 {
+		tlsConfig.VerifyConnection = warnExpiry(host, opts.expiryWarn)
+	}
+
+	client := &http.Client{
+		Transport: httpLogger{&http.Transport{
+			DialContext:     (&net.Dialer{Timeout: opts.connectTimeout, KeepAlive: opts.tcpKeepAlive}).DialContext,
+			TLSClientConfig: tlsConfig,
+		}, opts.verbose || opts.protocolLog},
+		Timeout:       opts.timeout,
+		CheckRedirect: opts.checkRedirect,
+	}
+
+	fileClient := client
+	if opts.fileTimeout > 0 {
+		fileClient = &http.Client{Transport: client.Transport, Timeout: opts.fileTimeout, CheckRedirect: opts.checkRedirect}
+	}
+
+	req := &http.Request{
+		URL:    &url.URL{Scheme: "https", Host: host + ":" + port},
+		Header: http.Header{},
+		//Header: http.Header{"Accept": []string{"application/json"}},
+	}
+
+	if opts.tokenFile == "" {
+		req.SetBasicAuth(user, pass)
+	} else {
+		token, errRT := readToken(opts.tokenFile)
+		if errRT != nil {
+			return nil, errRT
+		}
+
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	ac := &apiClient{client: client, fileClient: fileClient, base: req, opts: opts}
+
+	if opts.adaptiveMax > 0 {
+		if opts.adaptiveMin < 1 || opts.adaptiveMin > opts.adaptiveMax {
+			return nil, errors.New("-adaptive-min must be between 1 and -adaptive-max")
+		}
+
+		var log io.Writer
+		if opts.verbose {
+			log = os.Stderr
+		}
+
+		ac.limiter = newAdaptiveLimit(opts.adaptiveMin, opts.adaptiveMax, log)
+	}
+
+	return ac, nil
+}
+
+// readToken reads a -token-file. Errors never include the token itself.
+func readToken(path string) (string, error) {
+	raw, errRF := ioutil.ReadFile(path)
+	if errRF != nil {
+		return "", errRF
+	}
+
+	token := strings.TrimSpace(string(raw))
+	if token == "" {
+		return "", fmt.Errorf("%s: no token in there", path)
+	}
+
+	return token, nil
+}
+
+// checkRedirect limits redirects to -max-redirects and, unless -allow-cross-host-auth,
+// strips the credentials from ones leaving the master. (net/http would keep them for its subdomains.)
+func (co *clientOptions) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) > co.maxRedirects {
+		return fmt.Errorf("stopped after %d redirects (-max-redirects)", co.maxRedirects)
+	}
+
+	first := via[0]
+	if req.URL.Host != first.URL.Host {
+		if co.crossHostAuth {
+			req.Header.Set("Authorization", first.Header.Get("Authorization"))
+		} else {
+			req.Header.Del("Authorization")
+		}
+	}
+
+	if co.verbose {
+		fmt.Fprintf(os.Stderr, "following redirect from %s to %s\n", withoutUserinfo(via[len(via)-1].URL), withoutUserinfo(req.URL))
+	}
+
+	return nil
+}
+
+// warnExpiry returns a tls.Config#VerifyConnection warning once if the peer's certificate expires within window.
+// Unlike VerifyPeerCertificate, it also runs for resumed sessions (-tls-session-cache).
+func warnExpiry(host string, window time.Duration) func(tls.ConnectionState) error {
+	var once sync.Once
+
+	return func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) > 0 {
+			cert := cs.PeerCertificates[0]
+			if left := time.Until(cert.NotAfter); left < window {
+				once.Do(func() {
+					fmt.Fprintf(
+						os.Stderr, "warning: the TLS certificate of %s (%s) expires at %s, in %s\n",
+						host, cert.Subject.CommonName, cert.NotAfter.Format(time.RFC3339), left.Round(time.Minute),
+					)
+				})
+			}
+		}
+
+		return nil
+	}
+}
+
+// verifyChain verifies the peer's certificate chain like crypto/tls does, except for the host name.
+func verifyChain(cas *x509.CertPool) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) < 1 {
+			return errors.New("no TLS certificate presented")
+		}
+
+		certs := make([]*x509.Certificate, 0, len(rawCerts))
+		for _, raw := range rawCerts {
+			cert, errPC := x509.ParseCertificate(raw)
+			if errPC != nil {
+				return errPC
+			}
+
+			certs = append(certs, cert)
+		}
+
+		intermediates := x509.NewCertPool()
+		for _, cert := range certs[1:] {
+			intermediates.AddCert(cert)
+		}
+
+		_, errVf := certs[0].Verify(x509.VerifyOptions{
+			Roots: cas, Intermediates: intermediates, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		})
+		return errVf
+	}
+}
+
+// parseCAs is like AppendCertsFromPEM, but tells what's wrong.
+func parseCAs(data []byte) (*x509.CertPool, error) {
+	if len(bytes.TrimSpace(data)) == 0 {
+		return nil, errors.New("empty, contains no certificates")
+	}
+
+	pool := x509.NewCertPool()
+	parsed := 0
+
+	for {
+		block, rest := pem.Decode(data)
+		if block == nil {
+			break
+		}
+
+		data = rest
+
+		if block.Type != "CERTIFICATE" || len(block.Headers) > 0 {
+			continue
+		}
+
+		cert, errPC := x509.ParseCertificate(block.Bytes)
+		if errPC != nil {
+			return nil, fmt.Errorf("malformed certificate data after %d valid certificate(s): %s", parsed, errPC.Error())
+		}
+
+		pool.AddCert(cert)
+		parsed++
+	}
+
+	if parsed < 1 {
+		return nil, errors.New("contains no PEM certificates")
+	}
+
+	return pool, nil
+}
+
+func (ac *apiClient) withLog(log io.Writer) *apiClient {
+	clone := *ac
+	clone.base = ac.base.WithContext(context.WithValue(ac.base.Context(), logTo{}, log))
+	return &clone
+}
+
+// withContext lets ctx cancel the requests.
+func (ac *apiClient) withContext(ctx context.Context) *apiClient {
+	clone := *ac
+	clone.base = ac.base.WithContext(ctx)
+	return &clone
+}
+
+const caUsage = "`FILE`, http(s):// URL (fetched once and cached) or the PEM itself (default: $I2_CA)"
+
+// inlinePEM tells whether -ca is the certificate itself, not where to find it.
+func inlinePEM(ca string) bool {
+	return strings.HasPrefix(strings.TrimSpace(ca), "-----BEGIN")
+}
+
+func loadCA(ca string) ([]byte, error) {
+	if inlinePEM(ca) {
+		return []byte(ca), nil
+	}
+
+	if !strings.HasPrefix(ca, "http://") && !strings.HasPrefix(ca, "https://") {
+		return ioutil.ReadFile(ca)
+	}
+
+	cacheDir, errUC := os.UserCacheDir()
+	if errUC != nil {
+		return nil, errUC
+	}
+
+	cacheDir = filepath.Join(cacheDir, "i2pkg")
+	cache := filepath.Join(cacheDir, fmt.Sprintf("ca-%x.pem", sha256.Sum256([]byte(ca))))
+
+	if cached, errRF := ioutil.ReadFile(cache); errRF == nil {
+		return cached, nil
+	} else if !os.IsNotExist(errRF) {
+		return nil, errRF
+	}
+
+	resp, errGt := http.Get(ca)
+	if errGt != nil {
+		if ue, ok := errGt.(*url.Error); ok {
+			ue.URL = withoutURLUserinfo(ca)
+		}
+
+		return nil, errGt
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, badHttpStatus{code: resp.StatusCode}
+	}
+
+	pem, errRA := ioutil.ReadAll(resp.Body)
+	if errRA != nil {
+		return nil, errRA
+	}
+
+	if _, errPC := parseCAs(pem); errPC != nil {
+		return nil, fmt.Errorf("%s: %s", withoutURLUserinfo(ca), errPC.Error())
+	}
+
+	if errMA := os.MkdirAll(cacheDir, 0755); errMA != nil {
+		return nil, errMA
+	}
+
+	if errWF := ioutil.WriteFile(cache, pem, 0644); errWF != nil {
+		return nil, errWF
+	}
+
+	return pem, nil
+}
+
+// malformedJSON is a JSON response sendReqOnce (with -retry-decode-errors) couldn't parse.
+type malformedJSON struct {
+	err  error
+	body []byte
+}
+
+func (mj malformedJSON) Error() string {
+	return mj.err.Error()
+}
+
+func (ac *apiClient) sendReq(method, uri string, in, out interface{}) error {
+	var waited time.Duration
+	backoff := time.Second
+
+	for {
+		errSO := ac.sendReqOnce(method, uri, in, out)
+
+		mj, ok := errSO.(malformedJSON)
+		if !ok {
+			return errSO
+		}
+
+		if waited+backoff > ac.opts.retryBudget {
+			return mj.err
+		}
+
+		fmt.Fprintf(requestLog(ac.base), "%s, retrying in %s\n", mj.err.Error(), backoff)
+
+		if ac.opts.verbose {
+			fmt.Fprintf(os.Stderr, "malformed response to %s %s: %q\n", method, uri, mj.body)
+		}
+
+		time.Sleep(backoff)
+
+		waited += backoff
+		backoff *= 2
+	}
+}
+
+func (ac *apiClient) sendReqOnce(method, uri string, in, out interface{}) error {
+	base := ac.base
+	req := *base
+	url := *req.URL
+
+	ref, errPs := url.Parse(uri)
+	if errPs != nil {
+		return errPs
+	}
+
+	req.Method = method
+	req.URL = &url
+	url.Path = ref.Path
+	url.RawPath = ref.RawPath
+	url.RawQuery = ref.RawQuery
+
+	var body []byte
+
+	if in != nil {
+		buf := &bytes.Buffer{}
+		if errEc := json.NewEncoder(buf).Encode(in); errEc != nil {
+			return errEc
+		}
+
+		body = buf.Bytes()
+		req.Header = base.Header.Clone()
+		req.Header.Set("Accept", "application/json")
+		req.Header.Set("Content-Type", "application/json")
+		req.ContentLength = int64(buf.Len())
+	}
+
+	_, raw := out.(*[]byte)
+	archive, wantArchive := out.(*stageArchive)
+	head, wantHead := out.(*fileHead)
+	stream, wantStream := out.(*eventStream)
+	wantJSON := in == nil && out != nil && !raw && !wantArchive && !wantHead
+
+	if raw || wantArchive {
+		req = *req.WithContext(context.WithValue(req.Context(), fileRequest{}, true))
+	}
+
+	switch {
+	case wantJSON:
+		// Otherwise e.g. /v1 responds with HTML
+		req.Header = base.Header.Clone()
+		req.Header.Set("Accept", "application/json")
+	case wantArchive:
+		req.Header = base.Header.Clone()
+		req.Header.Set("Accept", archiveAccept)
+	}
+
+	ownHeader := in != nil || wantJSON || wantArchive
+
+	if ac.opts.tokenRefresh {
+		token, errRT := readToken(ac.opts.tokenFile)
+		if errRT != nil {
+			return errRT
+		}
+
+		if !ownHeader {
+			req.Header = base.Header.Clone()
+			ownHeader = true
+		}
+
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	if len(ac.opts.signCommand) > 0 {
+		if !ownHeader {
+			req.Header = base.Header.Clone()
+		}
+
+		if errSg := ac.sign(&req, body); errSg != nil {
+			return errSg
+		}
+	}
+
+	resp, errDo := ac.do(&req, body)
+	if errDo != nil {
+		return errDo
+	}
+
+	if wantStream && ac.opts.success(resp.StatusCode) {
+		stream.body = resp.Body
+		return nil
+	}
+
+	defer resp.Body.Close()
+
+	if !ac.opts.success(resp.StatusCode) {
+		bhs := badHttpStatus{code: resp.StatusCode}
+
+		if !wantArchive || resp.StatusCode != http.StatusNotAcceptable {
+			raw, _ := ioutil.ReadAll(resp.Body)
+			os.Stderr.Write(raw)
+			bhs.status = errorStatus(raw)
+		}
+
+		return bhs
+	}
+
+	if wantHead {
+		head.size = resp.ContentLength
+		head.checksum = digestChecksum(resp.Header)
+	} else if out != nil && resp.StatusCode != http.StatusNoContent {
+		if wantArchive {
+			body, errRA := ioutil.ReadAll(resp.Body)
+			if errRA != nil {
+				return errRA
+			}
+
+			archive.contentType = resp.Header.Get("Content-Type")
+			archive.body = body
+		} else if bs, ok := out.(*[]byte); ok {
+			body, errRB := ac.readBody(&req, resp)
+			if errRB != nil {
+				return errRB
+			}
+
+			*bs = body
+		} else {
+			var body io.Reader = resp.Body
+			var limited *io.LimitedReader
+			var captured *bytes.Buffer
+
+			if ac.opts.maxResponseSize > 0 {
+				limited = &io.LimitedReader{R: body, N: ac.opts.maxResponseSize + 1}
+				body = limited
+			}
+
+			if ac.opts.retryDecode {
+				captured = &bytes.Buffer{}
+				body = io.TeeReader(body, captured)
+			}
+
+			if errDc := ac.newDecoder(bufio.NewReader(body)).Decode(out); errDc != nil {
+				if limited != nil && limited.N < 1 {
+					return responseTooLarge{uri, ac.opts.maxResponseSize}
+				}
+
+				// Unlike unknown fields (-strict-json), these may be due to e.g. a flaky proxy.
+				if _, syntax := errDc.(*json.SyntaxError); captured != nil && (syntax || errDc == io.ErrUnexpectedEOF) {
+					return malformedJSON{fmt.Errorf("%s %s: %s", method, uri, errDc.Error()), captured.Bytes()}
+				}
+
+				if ac.opts.strictJSON {
+					return fmt.Errorf("%s %s: %s", method, uri, errDc.Error())
+				}
+
+				return errDc
+			}
+		}
+	}
+
+	return nil
+}
+
+// maxResumes limits how often readBody continues or repeats a broken download.
+const maxResumes = 3
+
+// readBody reads resp's body and, if that fails midway, requests the rest via a Range request (if the master said it
+// accepts them) or the whole thing again.
+func (ac *apiClient) readBody(req *http.Request, resp *http.Response) ([]byte, error) {
+	body, errRA := ioutil.ReadAll(resp.Body)
+
+	for attempt := 0; errRA != nil && attempt < maxResumes; attempt++ {
+		retry := *req
+		retry.Header = req.Header.Clone()
+
+		ranged := len(body) > 0 && resp.Header.Get("Accept-Ranges") == "bytes"
+		if ranged {
+			retry.Header.Set("Range", fmt.Sprintf("bytes=%d-", len(body)))
+			fmt.Fprintf(requestLog(req), "%s after %d bytes, resuming\n", errRA.Error(), len(body))
+		} else {
+			fmt.Fprintf(requestLog(req), "%s after %d bytes, downloading again\n", errRA.Error(), len(body))
+		}
+
+		var errDo error
+		resp, errDo = ac.do(&retry, nil)
+		if errDo != nil {
+			return nil, errDo
+		}
+
+		var rest []byte
+
+		switch {
+		case resp.StatusCode == http.StatusPartialContent && ranged:
+			if !strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", len(body))) {
+				resp.Body.Close()
+				return nil, fmt.Errorf("%s %s: unexpected Content-Range %q", req.Method, req.URL.Path, resp.Header.Get("Content-Range"))
+			}
+
+			rest, errRA = ioutil.ReadAll(resp.Body)
+			body = append(body, rest...)
+		case ac.opts.success(resp.StatusCode):
+			// Range not honored, but the complete content
+			body, errRA = ioutil.ReadAll(resp.Body)
+		default:
+			resp.Body.Close()
+			return nil, badHttpStatus{code: resp.StatusCode}
+		}
+
+		resp.Body.Close()
+	}
+
+	return body, errRA
+}
+
+func (ac *apiClient) limitedDo(req *http.Request) (*http.Response, error) {
+	client := ac.client
+	if req.Context().Value(fileRequest{}) != nil {
+		client = ac.fileClient
+	}
+
+	if ac.limiter == nil {
+		return client.Do(req)
+	}
+
+	generation := ac.limiter.acquire()
+	resp, errDo := client.Do(req)
+	ac.limiter.release(generation, errDo == nil && resp.StatusCode != 429 && resp.StatusCode < 500)
+
+	return resp, errDo
+}
+
+func (ac *apiClient) newDecoder(r io.Reader) *json.Decoder {
+	dec := json.NewDecoder(r)
+	if ac.opts.strictJSON {
+		dec.DisallowUnknownFields()
+	}
+
+	return dec
+}
+
+// do sends req (with body if not nil) and retries on HTTP 429 as long as the total wait fits into the retry budget.
+func (ac *apiClient) do(req *http.Request, body []byte) (*http.Response, error) {
+	var waited time.Duration
+	backoff := time.Second
+
+	for {
+		if body != nil {
+			req.Body = closableReader{bytes.NewReader(body)}
+		}
+
+		resp, errDo := ac.limitedDo(req)
+		if errDo != nil || resp.StatusCode != 429 {
+			return resp, errDo
+		}
+
+		wait := retryAfter(resp.Header.Get("Retry-After"), backoff)
+		if waited+wait > ac.opts.retryBudget {
+			return resp, nil
+		}
+
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+
+		fmt.Fprintf(requestLog(req), "HTTP 429, retrying in %s\n", wait)
+		time.Sleep(wait)
+
+		waited += wait
+		backoff *= 2
+	}
+}
+
+func retryAfter(header string, fallback time.Duration) time.Duration {
+	if header == "" {
+		return fallback
+	}
+
+	if seconds, errAt := strconv.Atoi(header); errAt == nil {
+		if seconds < 0 {
+			return 0
+		}
+
+		return time.Duration(seconds) * time.Second
+	}
+
+	if date, errPT := http.ParseTime(header); errPT == nil {
+		if wait := time.Until(date); wait > 0 {
+			return wait
+		}
+
+		return 0
+	}
+
+	return fallback
+}
+
+func (ac *apiClient) sign(req *http.Request, body []byte) error {
+	args := append(ac.opts.signCommand[1:len(ac.opts.signCommand):len(ac.opts.signCommand)], req.Method, req.URL.RequestURI())
+	cmd := exec.Command(ac.opts.signCommand[0], args...)
+	cmd.Stdin = bytes.NewReader(body)
+	cmd.Stderr = os.Stderr
+
+	out, errOp := cmd.Output()
+	if errOp != nil {
+		return fmt.Errorf("-sign-command: %s", errOp.Error())
+	}
+
+	for _, line := range strings.Split(string(out), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if line == "" {
+			continue
+		}
+
+		colon := strings.Index(line, ":")
+		if colon < 1 {
+			return fmt.Errorf("-sign-command: bad header line: %q", line)
+		}
+
+		req.Header.Add(strings.TrimSpace(line[:colon]), strings.TrimSpace(line[colon+1:]))
+	}
+
+	return nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// combinedEntry is a -combined document's value per package.
+type combinedEntry struct {
+	ActiveStage string `json:"active-stage"`
+	*bundle
+}
+
+// combinedWriter streams one JSON object into a file, one key at a time, not to hold all bundles in memory.
+type combinedWriter struct {
+	mtx        sync.Mutex
+	file       *os.File
+	buf        *bufio.Writer
+	enc        *json.Encoder
+	tmp, path  string
+	keys       int
+	escapeHTML bool
+}
+
+// newCombinedWriter starts writing path like writeJSON: - is stdout, regular files are replaced atomically by close.
+func newCombinedWriter(path string, escapeHTML bool) (*combinedWriter, error) {
+	cw := &combinedWriter{path: path, escapeHTML: escapeHTML}
+	var w io.Writer = os.Stdout
+
+	if path != "-" {
+		if info, errSt := os.Stat(path); errSt == nil && !info.Mode().IsRegular() {
+			f, errOp := os.OpenFile(path, os.O_WRONLY, 0)
+			if errOp != nil {
+				return nil, errOp
+			}
+
+			cw.file = f
+		} else {
+			cw.tmp = fmt.Sprintf("%s.%d.tmp", path, os.Getpid())
+
+			f, errOp := os.OpenFile(cw.tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+			if errOp != nil {
+				return nil, errOp
+			}
+
+			cw.file = f
+		}
+
+		w = cw.file
+	}
+
+	cw.buf = bufio.NewWriter(w)
+	cw.enc = newEncoder(cw.buf, escapeHTML)
+
+	if _, errWS := cw.buf.WriteString("{"); errWS != nil {
+		cw.abort()
+		return nil, errWS
+	}
+
+	return cw, nil
+}
+
+func (cw *combinedWriter) add(key string, value interface{}) error {
+	cw.mtx.Lock()
+	defer cw.mtx.Unlock()
+
+	if cw.keys > 0 {
+		if _, errWS := cw.buf.WriteString(","); errWS != nil {
+			return errWS
+		}
+	}
+
+	cw.keys++
+
+	if errEc := cw.enc.Encode(key); errEc != nil {
+		return errEc
+	}
+
+	if _, errWS := cw.buf.WriteString(":"); errWS != nil {
+		return errWS
+	}
+
+	return cw.enc.Encode(value)
+}
+
+func (cw *combinedWriter) close() error {
+	if _, errWS := cw.buf.WriteString("}\n"); errWS != nil {
+		cw.abort()
+		return errWS
+	}
+
+	if errFl := cw.buf.Flush(); errFl != nil {
+		cw.abort()
+		return errFl
+	}
+
+	if cw.file == nil {
+		return nil
+	}
+
+	if errCl := cw.file.Close(); errCl != nil {
+		cw.abort()
+		return errCl
+	}
+
+	if cw.tmp != "" {
+		if errCO := chownOutput(cw.tmp); errCO != nil {
+			cw.abort()
+			return errCO
+		}
+
+		return os.Rename(cw.tmp, cw.path)
+	}
+
+	return nil
+}
+
+// abort removes the incomplete temporary file, if any.
+func (cw *combinedWriter) abort() {
+	if cw.file != nil {
+		cw.file.Close()
+	}
+
+	if cw.tmp != "" {
+		os.Remove(cw.tmp)
+	}
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+func compareEnvs(args []string) {
+	fs := flag.NewFlagSet("compare-envs", flag.ExitOnError)
+	profilesFile := fs.String("profiles", "", "JSON `FILE` mapping environment names to host, port, ca, cn, user and password-env")
+	pkgName := fs.String("package", "", "`NAME` of the package to compare")
+	client := addClientFlags(fs)
+
+	fs.Parse(args)
+
+	if *profilesFile == "" {
+		fmt.Fprintln(os.Stderr, "-profiles missing")
+		exit(2)
+	}
+
+	if *pkgName == "" {
+		fmt.Fprintln(os.Stderr, "-package missing")
+		exit(2)
+	}
+
+	if fs.NArg() < 2 || fs.NArg() > 3 {
+		fmt.Fprintln(os.Stderr, "two or three environment names required")
+		exit(2)
+	}
+
+	profiles, errRP := readProfiles(*profilesFile)
+	if errRP != nil {
+		fmt.Fprintln(os.Stderr, errRP.Error())
+		exit(1)
+	}
+
+	envs := fs.Args()
+	bundles := make([]*bundle, len(envs))
+
+	for i, env := range envs {
+		profile, ok := profiles[env]
+		if !ok {
+			fmt.Fprintf(os.Stderr, "no such profile: %s\n", env)
+			exit(2)
+		}
+
+		api, errCn := profile.connect(client.options())
+		if errCn != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", env, errCn.Error())
+			exit(1)
+		}
+
+		api = api.withLog(os.Stderr)
+
+		var packages struct {
+			Results []stagedPackage `json:"results"`
+		}
+
+		if errSR := api.sendReq("GET", "/v1/config/packages", nil, &packages); errSR != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", env, errSR.Error())
+			exit(1)
+		}
+
+		bundles[i] = &bundle{}
+
+		exp := &exporter{api: api, fileConcurrency: 1, checksumAlgo: "sha256"}
+
+		for _, pkg := range packages.Results {
+			if pkg.Name == *pkgName {
+				if pkg.ActiveStage == "" {
+					break
+				}
+
+				bndl, errFt := exp.fetch(stageJob{pkg.Name, pkg.ActiveStage}, os.Stderr)
+				if errFt != nil {
+					fmt.Fprintf(os.Stderr, "%s: %s\n", env, errFt.Error())
+					exit(1)
+				}
+
+				bundles[i] = bndl
+				break
+			}
+		}
+
+		if bundles[i].Files == nil {
+			fmt.Fprintf(os.Stderr, "warning: %s: no active stage of %s\n", env, *pkgName)
+		}
+	}
+
+	var files []string
+	{
+		seen := map[string]bool{}
+		for _, bndl := range bundles {
+			for file := range bndl.Files {
+				if !seen[file] {
+					seen[file] = true
+					files = append(files, file)
+				}
+			}
+		}
+	}
+
+	sort.Strings(files)
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprint(tw, "\tFILE")
+
+	for _, env := range envs {
+		fmt.Fprintf(tw, "\t%s", env)
+	}
+
+	fmt.Fprintln(tw)
+
+	diverged := false
+
+	// Environments with equal content share a letter, "-" means absent.
+	for _, file := range files {
+		variants := map[[sha256.Size]byte]byte{}
+		cells := make([]string, len(envs))
+		missing := false
+
+		for i, bndl := range bundles {
+			content, ok := bndl.Files[file]
+			if !ok {
+				cells[i] = "-"
+				missing = true
+				continue
+			}
+
+			sum := sha256.Sum256([]byte(content))
+			variant, ok := variants[sum]
+			if !ok {
+				variant = 'A' + byte(len(variants))
+				variants[sum] = variant
+			}
+
+			cells[i] = string(variant)
+		}
+
+		mark := ""
+		switch {
+		case missing:
+			mark = "!"
+		case len(variants) > 1:
+			mark = "~"
+		}
+
+		if mark != "" {
+			diverged = true
+		}
+
+		fmt.Fprintf(tw, "%s\t%s", mark, file)
+
+		for _, cell := range cells {
+			fmt.Fprintf(tw, "\t%s", cell)
+		}
+
+		fmt.Fprintln(tw)
+	}
+
+	tw.Flush()
+
+	if diverged {
+		exit(1)
+	}
+}
+
+func compareRemote(args []string) {
+	fs := flag.NewFlagSet("compare-remote", flag.ExitOnError)
+	sides := [2]struct {
+		name                     string
+		host, port, ca, cn, user *string
+	}{{name: "A"}, {name: "B"}}
+
+	for i := range sides {
+		side := &sides[i]
+		suffix := "-" + strings.ToLower(side.name)
+
+		side.host = fs.String("host"+suffix, "", "master "+side.name+" `HOST`")
+		side.port = fs.String("port"+suffix, "5665", "master "+side.name+" `PORT`")
+		side.ca = fs.String("ca"+suffix, "", "master "+side.name+" CA `FILE`")
+		side.cn = fs.String("cn"+suffix, "", "master "+side.name+" certificate `CN` (default: -host"+suffix+")")
+		side.user = fs.String("user"+suffix, "", "master "+side.name+" API `USER`, password from $I2_PASS_"+side.name)
+	}
+
+	client := addClientFlags(fs)
+
+	fs.Parse(args)
+
+	var all [2]map[string]*bundle
+
+	for i, side := range sides {
+		profile := connProfile{
+			Host: *side.host, Port: *side.port, CA: *side.ca, CN: *side.cn, User: *side.user,
+			PasswordEnv: "I2_PASS_" + side.name,
+		}
+
+		api, errCn := profile.connect(client.options())
+		if errCn != nil {
+			fmt.Fprintf(os.Stderr, "master %s: %s\n", side.name, errCn.Error())
+			exit(1)
+		}
+
+		bundles, errFA := fetchAll(api.withLog(os.Stderr))
+		if errFA != nil {
+			fmt.Fprintf(os.Stderr, "master %s: %s\n", side.name, errFA.Error())
+			exit(1)
+		}
+
+		all[i] = bundles
+	}
+
+	var packages []string
+	{
+		seen := map[string]bool{}
+		for _, bundles := range all {
+			for name := range bundles {
+				if !seen[name] {
+					seen[name] = true
+					packages = append(packages, name)
+				}
+			}
+		}
+	}
+
+	sort.Strings(packages)
+
+	diverged := false
+
+	for _, name := range packages {
+		bndlA, okA := all[0][name]
+		bndlB, okB := all[1][name]
+
+		switch {
+		case !okA:
+			fmt.Printf("only on master B: %s\n", name)
+			diverged = true
+			continue
+		case !okB:
+			fmt.Printf("only on master A: %s\n", name)
+			diverged = true
+			continue
+		}
+
+		var files []string
+		for file := range bndlA.Files {
+			files = append(files, file)
+		}
+
+		for file := range bndlB.Files {
+			if _, ok := bndlA.Files[file]; !ok {
+				files = append(files, file)
+			}
+		}
+
+		sort.Strings(files)
+
+		for _, file := range files {
+			contentA, okA := bndlA.Files[file]
+			contentB, okB := bndlB.Files[file]
+			if okA && okB && contentA == contentB {
+				continue
+			}
+
+			nameA := "a/" + name + "/" + file
+			nameB := "b/" + name + "/" + file
+
+			if !okA {
+				nameA = "/dev/null"
+			}
+
+			if !okB {
+				nameB = "/dev/null"
+			}
+
+			unifiedDiff(os.Stdout, nameA, nameB, contentA, contentB)
+			diverged = true
+		}
+	}
+
+	if diverged {
+		exit(1)
+	}
+}
+
+// fetchAll fetches the active stages of all packages.
+func fetchAll(api *apiClient) (map[string]*bundle, error) {
+	var packages struct {
+		Results []stagedPackage `json:"results"`
+	}
+
+	if errSR := api.sendReq("GET", "/v1/config/packages", nil, &packages); errSR != nil {
+		return nil, errSR
+	}
+
+	bundles := map[string]*bundle{}
+
+	exp := &exporter{api: api, fileConcurrency: 1, checksumAlgo: "sha256"}
+
+	for _, pkg := range packages.Results {
+		if pkg.Name == "" || pkg.ActiveStage == "" {
+			continue
+		}
+
+		bndl, errFt := exp.fetch(stageJob{pkg.Name, pkg.ActiveStage}, os.Stderr)
+		if errFt != nil {
+			return nil, errFt
+		}
+
+		bundles[pkg.Name] = bndl
+	}
+
+	return bundles, nil
+}
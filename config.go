@@ -0,0 +1,61 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// secretEnv are the environment variables printConfig redacts.
+var secretEnv = []string{"I2_PASS"}
+
+// printConfig dumps the effective flag values (without credentials in URLs or PEM contents)
+// and which of them were given explicitly.
+func printConfig(fs *flag.FlagSet) {
+	config := struct {
+		Flags    map[string]string `json:"flags"`
+		Explicit []string          `json:"explicit"`
+		Env      map[string]string `json:"env"`
+		// of written bundles (split ones and previews: extendedFormatVersion)
+		FormatVersion int `json:"format-version"`
+	}{map[string]string{}, []string{}, map[string]string{}, bundleFormatVersion}
+
+	fs.VisitAll(func(f *flag.Flag) {
+		value := withoutURLUserinfo(f.Value.String())
+
+		if inlinePEM(value) {
+			value = "(inline PEM)"
+		}
+
+		config.Flags[f.Name] = value
+	})
+
+	// connFlags.validate falls back to $I2_CA only later.
+	if ca, ok := config.Flags["ca"]; ok && ca == "" {
+		if env := os.Getenv("I2_CA"); env != "" {
+			if inlinePEM(env) {
+				config.Flags["ca"] = "(from $I2_CA, inline PEM)"
+			} else {
+				config.Flags["ca"] = "(from $I2_CA) " + withoutURLUserinfo(env)
+			}
+		}
+	}
+
+	fs.Visit(func(f *flag.Flag) {
+		config.Explicit = append(config.Explicit, f.Name)
+	})
+
+	sort.Strings(config.Explicit)
+
+	for _, name := range secretEnv {
+		if _, ok := os.LookupEnv(name); ok {
+			config.Env[name] = "(redacted)"
+		}
+	}
+
+	if errEJ := encodeJSON(os.Stdout, config, false); errEJ != nil {
+		fmt.Fprintln(os.Stderr, errEJ.Error())
+		exit(1)
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+const diffContext = 3
+
+// Beyond this many differing lines, unifiedDiff doesn't bother to find common ones.
+const diffMaxEdits = 2000
+
+type lineEdit struct {
+	op   byte
+	line string
+}
+
+// unifiedDiff writes a `diff -u` style diff of a and b to w.
+func unifiedDiff(w io.Writer, nameA, nameB, a, b string) {
+	edits := diffLines(splitLines(a), splitLines(b))
+
+	fmt.Fprintf(w, "--- %s\n+++ %s\n", nameA, nameB)
+
+	// Number of lines of a and b before each edit
+	posA := make([]int, len(edits)+1)
+	posB := make([]int, len(edits)+1)
+
+	for i, edit := range edits {
+		posA[i+1], posB[i+1] = posA[i], posB[i]
+
+		if edit.op != '+' {
+			posA[i+1]++
+		}
+
+		if edit.op != '-' {
+			posB[i+1]++
+		}
+	}
+
+	for i := 0; i < len(edits); {
+		if edits[i].op == ' ' {
+			i++
+			continue
+		}
+
+		start := i - diffContext
+		if start < 0 {
+			start = 0
+		}
+
+		j := i
+		for {
+			for j < len(edits) && edits[j].op != ' ' {
+				j++
+			}
+
+			k := j
+			for k < len(edits) && edits[k].op == ' ' && k-j < 2*diffContext {
+				k++
+			}
+
+			if k < len(edits) && edits[k].op != ' ' {
+				j = k
+				continue
+			}
+
+			break
+		}
+
+		end := j + diffContext
+		if end > len(edits) {
+			end = len(edits)
+		}
+
+		fmt.Fprintf(
+			w, "@@ -%s +%s @@\n",
+			hunkRange(posA[start], posA[end]-posA[start]), hunkRange(posB[start], posB[end]-posB[start]),
+		)
+
+		for _, edit := range edits[start:end] {
+			fmt.Fprintf(w, "%c%s", edit.op, edit.line)
+
+			if !strings.HasSuffix(edit.line, "\n") {
+				fmt.Fprint(w, "\n\\ No newline at end of file\n")
+			}
+		}
+
+		i = end
+	}
+}
+
+func hunkRange(before, length int) string {
+	if length == 0 {
+		return fmt.Sprintf("%d,0", before)
+	}
+
+	if length == 1 {
+		return fmt.Sprintf("%d", before+1)
+	}
+
+	return fmt.Sprintf("%d,%d", before+1, length)
+}
+
+func splitLines(s string) []string {
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	return lines
+}
+
+// diffLines implements the Myers diff algorithm.
+func diffLines(a, b []string) []lineEdit {
+	n, m := len(a), len(b)
+	offset := n + m + 1
+	v := make([]int, 2*offset+1)
+	var trace [][]int
+
+	for d := 0; d <= n+m; d++ {
+		if d > diffMaxEdits {
+			return replaceAll(a, b)
+		}
+
+		trace = append(trace, append([]int(nil), v[offset-d-1:offset+d+2]...))
+
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || k != d && v[offset+k-1] < v[offset+k+1] {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+
+			v[offset+k] = x
+
+			if x >= n && y >= m {
+				return backtrack(a, b, trace)
+			}
+		}
+	}
+
+	return nil
+}
+
+func backtrack(a, b []string, trace [][]int) []lineEdit {
+	var reversed []lineEdit
+	x, y := len(a), len(b)
+
+	for d := len(trace) - 1; d >= 0; d-- {
+		// trace[d] starts at k = -d-1
+		v := func(k int) int {
+			return trace[d][k+d+1]
+		}
+
+		k := x - y
+		var prevK int
+
+		if k == -d || k != d && v(k-1) < v(k+1) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+
+		prevX := v(prevK)
+		prevY := prevX - prevK
+
+		for x > prevX && y > prevY {
+			reversed = append(reversed, lineEdit{' ', a[x-1]})
+			x--
+			y--
+		}
+
+		if d > 0 {
+			if x == prevX {
+				reversed = append(reversed, lineEdit{'+', b[y-1]})
+			} else {
+				reversed = append(reversed, lineEdit{'-', a[x-1]})
+			}
+		}
+
+		x, y = prevX, prevY
+	}
+
+	edits := make([]lineEdit, 0, len(reversed))
+	for i := len(reversed) - 1; i >= 0; i-- {
+		edits = append(edits, reversed[i])
+	}
+
+	return edits
+}
+
+func replaceAll(a, b []string) []lineEdit {
+	edits := make([]lineEdit, 0, len(a)+len(b))
+
+	for _, line := range a {
+		edits = append(edits, lineEdit{'-', line})
+	}
+
+	for _, line := range b {
+		edits = append(edits, lineEdit{'+', line})
+	}
+
+	return edits
+}
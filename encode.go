@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"sort"
+)
+
+// encodeBundle returns bndl as -encode mode wants it in JSON. Base64 lists the encoded files,
+// so readBundle can decode them. Older readers refuse such bundles due to the format version.
+func encodeBundle(bndl *bundle, mode string) *bundle {
+	if mode == "raw" {
+		return bndl
+	}
+
+	encoded := *bndl
+	encoded.Encoding = mode
+	encoded.Files = make(map[string]string, len(bndl.Files))
+	encoded.Base64 = nil
+
+	for name, content := range bndl.Files {
+		if mode == "base64" || isBinary(content) {
+			content = base64.StdEncoding.EncodeToString([]byte(content))
+			encoded.Base64 = append(encoded.Base64, name)
+		}
+
+		encoded.Files[name] = content
+	}
+
+	if len(encoded.Base64) > 0 {
+		sort.Strings(encoded.Base64)
+		encoded.FormatVersion = extendedFormatVersion
+	}
+
+	return &encoded
+}
+
+// decodeBundle reverts encodeBundle.
+func decodeBundle(bndl *bundle) error {
+	for _, name := range bndl.Base64 {
+		content, ok := bndl.Files[name]
+		if !ok {
+			return fmt.Errorf("%s is listed as base64-encoded, but not in the bundle", name)
+		}
+
+		raw, errDS := base64.StdEncoding.DecodeString(content)
+		if errDS != nil {
+			return fmt.Errorf("%s: %s", name, errDS.Error())
+		}
+
+		bndl.Files[name] = string(raw)
+	}
+
+	bndl.Base64 = nil
+	return nil
+}
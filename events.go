@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// eventStream is an open /v1/events response, one JSON event per line.
+type eventStream struct {
+	body io.ReadCloser
+}
+
+// defaultEventTypes hint at config changes. Activating a stage restarts Icinga 2 which ends the stream anyway.
+var defaultEventTypes = []string{"ObjectCreated", "ObjectModified", "ObjectDeleted"}
+
+// events keeps exporting the packages whose active stage changed whenever the master's event stream says something
+// happened or (e.g. due to a reload) ends.
+func events(args []string) {
+	fs := flag.NewFlagSet("events", flag.ExitOnError)
+	conn := addConnFlags(fs)
+	queue := fs.String("queue", "i2pkg", "event stream queue `NAME` (unique per subscriber)")
+	var types stringList
+	fs.Var(&types, "type", "subscribe to event `TYPE` (repeatable, default: ObjectCreated, ObjectModified and ObjectDeleted)")
+	debounce := fs.Duration("debounce", 5*time.Second, "export once no more events arrived for `DURATION`")
+	maxBackoff := fs.Duration("max-backoff", time.Minute, "wait at most `DURATION` between reconnection attempts")
+	exportArgs := fs.String(
+		"export-args", "", "run each export with the whitespace-separated `FLAGS`, e.g. '-out-template /backup -format dir'",
+	)
+	healthAddr := fs.String(
+		"health-addr", "",
+		"serve /healthz (liveness), /readyz (200 once an export succeeded) and /status (last export, JSON) on `ADDRESS`, e.g. :8080",
+	)
+
+	fs.Parse(args)
+	conn.validate()
+
+	if len(types) < 1 {
+		types = defaultEventTypes
+	}
+
+	self, errEx := os.Executable()
+	if errEx != nil {
+		fmt.Fprintln(os.Stderr, errEx.Error())
+		exit(1)
+	}
+
+	var health *healthState
+	if *healthAddr != "" {
+		hs, errSH := serveHealth(*healthAddr)
+		if errSH != nil {
+			fmt.Fprintf(os.Stderr, "-health-addr: %s\n", errSH.Error())
+			exit(1)
+		}
+
+		health = hs
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		<-signals
+		cancel()
+	}()
+
+	api := conn.connect().withContext(ctx)
+
+	// Unlike other responses, the stream is supposed to last.
+	streamClient := *api.client
+	streamClient.Timeout = 0
+	api.client = &streamClient
+
+	connArgs := []string{"-host", *conn.host, "-port", *conn.port, "-cn", *conn.cn}
+	env := os.Environ()
+
+	// Unlike the environment, argv is visible to everyone via ps.
+	if inlinePEM(*conn.ca) {
+		env = append(env, "I2_CA="+*conn.ca)
+	} else {
+		connArgs = append(connArgs, "-ca", *conn.ca)
+	}
+
+	if *conn.client.tokenFile == "" {
+		connArgs = append(connArgs, "-user", *conn.user)
+	}
+
+	connArgs = append(connArgs, clientArgs(fs)...)
+
+	em := &eventMirror{
+		api: api, self: self, args: append(connArgs, strings.Fields(*exportArgs)...), env: env, known: map[string]string{},
+		health: health,
+	}
+
+	subscribed := false
+	backoff := time.Second
+
+	for {
+		stream := &eventStream{}
+		errSR := api.sendReq("POST", "/v1/events", &struct {
+			Queue string   `json:"queue"`
+			Types []string `json:"types"`
+		}{*queue, types}, stream)
+
+		if ctx.Err() != nil {
+			exit(0)
+		}
+
+		if errSR != nil {
+			if bhs, ok := errSR.(badHttpStatus); ok && !subscribed {
+				switch bhs.code {
+				case http.StatusBadRequest, http.StatusNotFound:
+					fmt.Fprintf(
+						os.Stderr, "the master doesn't offer an event stream of %s (%s)\n", strings.Join(types, ", "), errSR.Error(),
+					)
+					exit(1)
+				case http.StatusUnauthorized, http.StatusForbidden:
+					fmt.Fprintln(os.Stderr, errSR.Error())
+					exit(1)
+				}
+			}
+
+			fmt.Fprintf(os.Stderr, "%s, reconnecting in %s\n", errSR.Error(), backoff)
+
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				exit(0)
+			}
+
+			if backoff *= 2; backoff > *maxBackoff {
+				backoff = *maxBackoff
+			}
+
+			continue
+		}
+
+		subscribed = true
+		backoff = time.Second
+		fmt.Printf("subscribed to %s\n", strings.Join(types, ", "))
+
+		// Changes may have happened while not subscribed, the first time all packages are new.
+		em.sync()
+
+		errFl := em.follow(ctx, stream.body, *debounce)
+		stream.body.Close()
+
+		if ctx.Err() != nil {
+			exit(0)
+		}
+
+		if errFl == nil {
+			fmt.Println("event stream ended (e.g. master reloaded), reconnecting")
+		} else {
+			fmt.Fprintf(os.Stderr, "event stream broke: %s, reconnecting\n", errFl.Error())
+		}
+	}
+}
+
+type eventMirror struct {
+	api  *apiClient
+	self string
+	// connection and -export-args
+	args []string
+	// incl. an inline PEM -ca
+	env []string
+	// the packages' last exported active stages
+	known  map[string]string
+	health *healthState
+}
+
+// follow syncs debounce after the last of several events until the stream ends.
+func (em *eventMirror) follow(ctx context.Context, stream io.Reader, debounce time.Duration) error {
+	lines := make(chan struct{})
+	ended := make(chan error, 1)
+	quit := make(chan struct{})
+
+	defer close(quit)
+
+	go func() {
+		scanner := bufio.NewScanner(stream)
+		scanner.Buffer(nil, 16<<20)
+
+		for scanner.Scan() {
+			select {
+			case lines <- struct{}{}:
+			case <-quit:
+				return
+			}
+		}
+
+		ended <- scanner.Err()
+	}()
+
+	var quiet <-chan time.Time
+
+	for {
+		select {
+		case <-lines:
+			quiet = time.After(debounce)
+		case <-quiet:
+			quiet = nil
+			em.sync()
+		case errSc := <-ended:
+			if quiet != nil {
+				em.sync()
+			}
+
+			return errSc
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// sync exports the packages whose active stage isn't known yet. Failed ones are tried again next time.
+func (em *eventMirror) sync() {
+	var packages struct {
+		Results []stagedPackage `json:"results"`
+	}
+
+	if errSR := em.api.sendReq("GET", "/v1/config/packages", nil, &packages); errSR != nil {
+		fmt.Fprintln(os.Stderr, errSR.Error())
+		em.health.record(nil, 0, 0, errSR)
+		return
+	}
+
+	current := map[string]string{}
+	var changed []string
+
+	for _, pkg := range packages.Results {
+		if pkg.ActiveStage == "" {
+			continue
+		}
+
+		current[pkg.Name] = pkg.ActiveStage
+		if em.known[pkg.Name] != pkg.ActiveStage {
+			changed = append(changed, pkg.Name)
+		}
+	}
+
+	for name := range em.known {
+		if _, ok := current[name]; !ok {
+			fmt.Printf("%s is gone or has no active stage anymore\n", name)
+		}
+	}
+
+	if len(changed) < 1 {
+		em.known = current
+		em.health.record(nil, 0, 0, nil)
+		return
+	}
+
+	sort.Strings(changed)
+	fmt.Printf("exporting %s\n", strings.Join(changed, ", "))
+
+	files, bytes, errEx := em.export(changed)
+	em.health.record(changed, files, bytes, errEx)
+
+	if errEx != nil {
+		fmt.Fprintf(os.Stderr, "export failed: %s, retrying with the next change\n", errEx.Error())
+		return
+	}
+
+	em.known = current
+}
+
+// export runs an export of the named packages and returns how many files and bytes it wrote (see -results).
+func (em *eventMirror) export(names []string) (int, int, error) {
+	list, errTF := ioutil.TempFile("", "i2pkg-events-")
+	if errTF != nil {
+		return 0, 0, errTF
+	}
+
+	defer os.Remove(list.Name())
+
+	if _, errWS := list.WriteString(strings.Join(names, "\n") + "\n"); errWS != nil {
+		list.Close()
+		return 0, 0, errWS
+	}
+
+	if errCl := list.Close(); errCl != nil {
+		return 0, 0, errCl
+	}
+
+	results, errTF := ioutil.TempFile("", "i2pkg-results-")
+	if errTF != nil {
+		return 0, 0, errTF
+	}
+
+	results.Close()
+	defer os.Remove(results.Name())
+
+	cmd := exec.Command(em.self, append(
+		em.args, "-package-list", list.Name(), "-results", results.Name(), "-checksums-reset",
+	)...)
+	cmd.Env = em.env
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	if errRn := cmd.Run(); errRn != nil {
+		return 0, 0, errRn
+	}
+
+	content, errRF := ioutil.ReadFile(results.Name())
+	if errRF != nil {
+		return 0, 0, errRF
+	}
+
+	var exported []fileResult
+	if errUJ := json.Unmarshal(content, &exported); errUJ != nil {
+		return 0, 0, errUJ
+	}
+
+	bytes := 0
+	for _, file := range exported {
+		bytes += file.Bytes
+	}
+
+	return len(exported), bytes, nil
+}
+
+// clientArgs returns the explicitly set flags of addClientFlags in fs as arguments for an export.
+func clientArgs(fs *flag.FlagSet) []string {
+	client := flag.NewFlagSet("", flag.ContinueOnError)
+	addClientFlags(client)
+
+	var args []string
+	fs.Visit(func(f *flag.Flag) {
+		if client.Lookup(f.Name) == nil {
+			return
+		}
+
+		if list, ok := f.Value.(*stringList); ok {
+			for _, value := range *list {
+				args = append(args, "-"+f.Name, value)
+			}
+		} else {
+			args = append(args, "-"+f.Name+"="+f.Value.String())
+		}
+	})
+
+	return args
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"flag"
+	"reflect"
+	"testing"
+)
+
+func TestClientArgs(t *testing.T) {
+	fs := flag.NewFlagSet("events", flag.ContinueOnError)
+	addConnFlags(fs)
+	fs.String("queue", "i2pkg", "")
+
+	errPs := fs.Parse([]string{
+		"-host", "master", "-queue", "q", "-insecure-host", "a", "-timeout", "1m", "-insecure-host", "b",
+		"-skip-hostname-verify", "-tls-session-cache=false", "-accept-status", "200,204",
+	})
+	if errPs != nil {
+		t.Fatal(errPs)
+	}
+
+	want := []string{
+		"-accept-status=200,204", "-insecure-host", "a", "-insecure-host", "b",
+		"-skip-hostname-verify=true", "-timeout=1m0s", "-tls-session-cache=false",
+	}
+
+	if args := clientArgs(fs); !reflect.DeepEqual(args, want) {
+		t.Errorf("clientArgs() = %q, want %q", args, want)
+	}
+}
@@ -0,0 +1,19 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// tryLock takes an exclusive flock on f or returns errLocked if another process holds one.
+func tryLock(f *os.File) error {
+	errFl := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if errFl == syscall.EWOULDBLOCK {
+		return errLocked
+	}
+
+	return errFl
+}
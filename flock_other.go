@@ -0,0 +1,13 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+func tryLock(*os.File) error {
+	return errors.New("-lockfile isn't supported on this OS")
+}
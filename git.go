@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+const gitIgnore = `# written by i2pkg -git-attributes
+# (leftovers of interrupted writes)
+*.tmp
+`
+
+// gitFiles are the names written by -git-attributes which don't make an export directory foreign.
+var gitFiles = map[string]bool{".gitattributes": true, ".gitignore": true}
+
+// isBinary tells whether git shouldn't treat content as (LF-normalized) text.
+func isBinary(content string) bool {
+	return !utf8.ValidString(content) || strings.IndexByte(content, 0) >= 0
+}
+
+// writeGitFiles writes .gitattributes (LF for text, binary for tarballs and the given paths) and .gitignore into dir.
+func writeGitFiles(dir string, binary []string) error {
+	sort.Strings(binary)
+
+	attrs := &strings.Builder{}
+	attrs.WriteString("# written by i2pkg -git-attributes\n* text=auto eol=lf\n*.tar.gz binary\n")
+
+	for _, path := range binary {
+		attrs.WriteString(gitPattern(path))
+		attrs.WriteString(" binary\n")
+	}
+
+	files := map[string]string{".gitattributes": attrs.String(), ".gitignore": gitIgnore}
+
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+
+		if errWF := ioutil.WriteFile(path, []byte(content), 0644); errWF != nil {
+			return errWF
+		}
+
+		if errCO := chownOutput(path); errCO != nil {
+			return errCO
+		}
+	}
+
+	return nil
+}
+
+// gitPattern matches exactly path (relative to the .gitattributes, with slashes) in a .gitattributes.
+// Whitespace etc. requires git's C-style quoting.
+func gitPattern(path string) string {
+	pattern := []byte{'/'}
+	quote := false
+
+	for i := 0; i < len(path); i++ {
+		switch c := path[i]; {
+		case c == '\\' || c == '*' || c == '?' || c == '[':
+			pattern = append(pattern, '\\', c)
+		case c <= ' ' || c == '"' || c >= 0x7f:
+			quote = true
+			fallthrough
+		default:
+			pattern = append(pattern, c)
+		}
+	}
+
+	if !quote {
+		return string(pattern)
+	}
+
+	quoted := &strings.Builder{}
+	quoted.WriteByte('"')
+
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; {
+		case c == '\\' || c == '"':
+			quoted.WriteByte('\\')
+			quoted.WriteByte(c)
+		case c < ' ' || c >= 0x7f:
+			fmt.Fprintf(quoted, "\\%03o", c)
+		default:
+			quoted.WriteByte(c)
+		}
+	}
+
+	quoted.WriteByte('"')
+	return quoted.String()
+}
+
+// gitCommit commits everything below dir (in a git working tree), if anything changed, and pushes it to remote if not empty.
+func gitCommit(dir, message, remote string) (bool, error) {
+	if _, errGt := git(dir, "add", "-A", "--", "."); errGt != nil {
+		return false, errGt
+	}
+
+	if _, errGt := git(dir, "diff", "--cached", "--quiet", "--", "."); errGt == nil {
+		return false, nil
+	} else if ee, ok := errGt.(*gitError); !ok || ee.status != 1 {
+		return false, errGt
+	}
+
+	// Only dir, not whatever else may be staged
+	if _, errGt := git(dir, "commit", "-q", "-m", message, "--", "."); errGt != nil {
+		return false, errGt
+	}
+
+	if remote != "" {
+		if _, errGt := git(dir, "push", "-q", remote, "HEAD"); errGt != nil {
+			return true, errGt
+		}
+	}
+
+	return true, nil
+}
+
+type gitError struct {
+	args   []string
+	status int
+	output []byte
+}
+
+func (ge *gitError) Error() string {
+	return fmt.Sprintf("git %s: exit status %d: %s", strings.Join(ge.args, " "), ge.status, bytes.TrimSpace(ge.output))
+}
+
+func git(dir string, args ...string) ([]byte, error) {
+	out, errCO := exec.Command("git", append([]string{"-C", dir}, args...)...).CombinedOutput()
+	if ee, ok := errCO.(*exec.ExitError); ok {
+		return out, &gitError{args, ee.ExitCode(), out}
+	}
+
+	return out, errCO
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"path"
+	"strings"
+)
+
+// matchGlob matches name against pattern like path.Match, but "**" matches any number of directories.
+// Patterns without any / match the base name, e.g. *.key matches conf.d/secret.key.
+func matchGlob(pattern, name string) bool {
+	if !strings.Contains(pattern, "/") {
+		ok, _ := path.Match(pattern, path.Base(name))
+		return ok
+	}
+
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+
+			return false
+		}
+
+		if len(name) < 1 {
+			return false
+		}
+
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+
+		pattern, name = pattern[1:], name[1:]
+	}
+
+	return len(name) < 1
+}
+
+// validGlob tells whether matchGlob understands pattern.
+func validGlob(pattern string) bool {
+	for _, segment := range strings.Split(pattern, "/") {
+		if _, errMt := path.Match(segment, ""); errMt != nil {
+			return false
+		}
+	}
+
+	return true
+}
@@ -1,3 +1,3 @@
 module i2pkg
 
-go 1.14
+go 1.15
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// fileHead is what sendReq fills from a HEAD response instead of decoding a body.
+type fileHead struct {
+	size     int64
+	checksum fileChecksum
+}
+
+// digestChecksum takes the checksums a master may announce in Repr-Digest, Content-Digest (RFC 9530) or Digest (RFC 3230).
+func digestChecksum(header http.Header) fileChecksum {
+	var sum fileChecksum
+
+	for _, key := range []string{"Repr-Digest", "Content-Digest", "Digest"} {
+		for _, value := range header.Values(key) {
+			for _, digest := range strings.Split(value, ",") {
+				kv := strings.SplitN(strings.TrimSpace(digest), "=", 2)
+				if len(kv) < 2 {
+					continue
+				}
+
+				raw, errDS := base64.StdEncoding.DecodeString(strings.Trim(kv[1], ":"))
+				if errDS != nil {
+					continue
+				}
+
+				switch strings.ToLower(kv[0]) {
+				case "sha-256":
+					if sum.Sha256 == "" {
+						sum.Sha256 = fmt.Sprintf("%x", raw)
+					}
+				case "sha-512":
+					if sum.Sha512 == "" {
+						sum.Sha512 = fmt.Sprintf("%x", raw)
+					}
+				}
+			}
+		}
+	}
+
+	return sum
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// healthState is what -health-addr reports about the export cycles so far.
+type healthState struct {
+	mtx    sync.Mutex
+	status healthStatus
+}
+
+type healthStatus struct {
+	Started time.Time  `json:"started"`
+	LastRun *time.Time `json:"last-run,omitempty"`
+	// whether any cycle succeeded yet (/readyz)
+	Ready bool `json:"ready"`
+	// the last cycle's outcome
+	Error    string   `json:"error,omitempty"`
+	Exported []string `json:"exported"`
+	Files    int      `json:"files"`
+	Bytes    int      `json:"bytes"`
+}
+
+// record notes a finished export cycle, errCy being its failure if any.
+func (hs *healthState) record(exported []string, files, bytes int, errCy error) {
+	if hs == nil {
+		return
+	}
+
+	now := time.Now()
+	if exported == nil {
+		exported = []string{}
+	}
+
+	hs.mtx.Lock()
+	defer hs.mtx.Unlock()
+
+	hs.status.LastRun = &now
+	hs.status.Exported = exported
+	hs.status.Files = files
+	hs.status.Bytes = bytes
+
+	if errCy == nil {
+		hs.status.Ready = true
+		hs.status.Error = ""
+	} else {
+		hs.status.Error = errCy.Error()
+	}
+}
+
+// serveHealth serves /healthz, /readyz and /status (JSON) on addr in the background.
+func serveHealth(addr string) (*healthState, error) {
+	listener, errLn := net.Listen("tcp", addr)
+	if errLn != nil {
+		return nil, errLn
+	}
+
+	hs := &healthState{status: healthStatus{Started: time.Now(), Exported: []string{}}}
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, _ *http.Request) {
+		hs.mtx.Lock()
+		ready := hs.status.Ready
+		hs.mtx.Unlock()
+
+		if !ready {
+			http.Error(w, "no successful export yet", http.StatusServiceUnavailable)
+			return
+		}
+
+		fmt.Fprintln(w, "ok")
+	})
+
+	mux.HandleFunc("/status", func(w http.ResponseWriter, _ *http.Request) {
+		hs.mtx.Lock()
+		body, errMs := json.Marshal(&hs.status)
+		hs.mtx.Unlock()
+
+		if errMs != nil {
+			http.Error(w, errMs.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(append(body, '\n'))
+	})
+
+	go func() {
+		if errSv := http.Serve(listener, mux); errSv != nil {
+			fmt.Fprintf(os.Stderr, "-health-addr: %s\n", errSv.Error())
+			exit(1)
+		}
+	}()
+
+	return hs, nil
+}
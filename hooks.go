@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+)
+
+type postHook struct {
+	command []string
+	strict  bool
+	log     io.Writer
+}
+
+// run runs the hook and tells whether the caller may carry on, i.e. whether it succeeded or isn't strict.
+func (ph *postHook) run(pkg, path string, status int) bool {
+	cmd := exec.Command(ph.command[0], ph.command[1:]...)
+	cmd.Env = append(
+		os.Environ(), "I2PKG_PACKAGE="+pkg, "I2PKG_FILE_PATH="+path, "I2PKG_EXIT_STATUS="+strconv.Itoa(status),
+	)
+
+	out, errCO := cmd.CombinedOutput()
+	ph.log.Write(out)
+
+	if errCO != nil {
+		if ph.strict {
+			fmt.Fprintf(os.Stderr, "-post-hook: %s\n", errCO.Error())
+			return false
+		}
+
+		fmt.Fprintf(os.Stderr, "warning: -post-hook: %s\n", errCO.Error())
+	}
+
+	return true
+}
@@ -0,0 +1,721 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+var includeDirective = regexp.MustCompile(`(?m)^\s*(include|include_recursive)\s+"([^"]+)"`)
+
+func importPackages(args []string) {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	conn := addConnFlags(fs)
+	addPrefix := fs.String("strip-path-prefix", "", "re-add `PREFIX` removed on export to all file names")
+	var deleteFiles stringList
+	fs.Var(
+		&deleteFiles, "delete-file",
+		"omit `PATH` from the bundle (repeatable) - as stages are immutable, this creates and activates a new stage without it",
+	)
+	checkMeta := fs.Bool("check-meta", false, "warn if a package's active stage differs from the one recorded by -with-meta")
+	checkIncludes := fs.Bool("check-includes", false, "warn about include(_recursive) directives referring to files missing in the bundle")
+	activate := fs.Bool(
+		"activate", true,
+		"let the master activate the stages once validated (-activate=false requires Icinga 2 v2.13+, older ones activate anyway)",
+	)
+	waitActive := fs.Duration(
+		"wait-active", 0, "wait up to `DURATION` for each created stage to become active and fail if it doesn't (e.g. invalid config)",
+	)
+	formatVersionMin := fs.Int("format-version-min", 1, "refuse bundles of a format older than `VERSION`")
+	validateOnly := fs.Bool(
+		"validate-only", false,
+		"just let the master validate the bundles as new, not activated stages, print their startup.log, delete them "+
+			"and fail if any is invalid",
+	)
+	keepStage := fs.Bool("keep-stage", false, "don't delete -validate-only's stages")
+	var rewrites stringList
+	fs.Var(
+		&rewrites, "rewrite-prefix",
+		"replace the file name prefix `OLD=NEW` (repeatable, the first matching one wins, empty OLD matches all) "+
+			"after -strip-path-prefix and before -delete-file, e.g. to import into another package layout",
+	)
+	verifyUpload := fs.Bool("verify-upload", false, "read each created stage's files back and compare them to the bundle")
+	verifyRetries := fs.Int(
+		"verify-retries", 0,
+		"create a stage up to `NUMBER` more times if -verify-upload found discrepancies - the attempts aren't activated "+
+			"(Icinga 2 v2.13+) and differing ones get deleted, a matching one gets uploaded again to be activated, "+
+			"so if the retries run out, the package stays as it was",
+	)
+
+	fs.Parse(args)
+	conn.validate()
+
+	if *validateOnly {
+		*activate = false
+	}
+
+	if *formatVersionMin < 1 || *formatVersionMin > extendedFormatVersion {
+		fmt.Fprintf(os.Stderr, "-format-version-min must be between 1 and %d\n", extendedFormatVersion)
+		exit(2)
+	}
+
+	if *verifyRetries < 0 {
+		fmt.Fprintln(os.Stderr, "-verify-retries must not be negative")
+		exit(2)
+	}
+
+	if *verifyRetries > 0 && !*verifyUpload {
+		fmt.Fprintln(os.Stderr, "-verify-retries requires -verify-upload")
+		exit(2)
+	}
+
+	if fs.NArg() < 1 {
+		fmt.Fprintln(os.Stderr, "bundle FILE(s) missing")
+		exit(2)
+	}
+
+	var prefixRewrites [][2]string
+	for _, rewrite := range rewrites {
+		eq := strings.Index(rewrite, "=")
+		if eq < 0 {
+			fmt.Fprintf(os.Stderr, "-rewrite-prefix %q: OLD=NEW expected\n", rewrite)
+			exit(2)
+		}
+
+		prefixRewrites = append(prefixRewrites, [2]string{rewrite[:eq], rewrite[eq+1:]})
+	}
+
+	deleted := map[string]bool{}
+	for _, file := range deleteFiles {
+		deleted[file] = true
+	}
+
+	bundles := make([]*bundle, 0, fs.NArg())
+	names := make([]string, 0, fs.NArg())
+
+	for _, file := range fs.Args() {
+		bndl, errRB := readBundle(file, *formatVersionMin)
+		if errRB != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", file, errRB.Error())
+			exit(1)
+		}
+
+		name, errBP := bundlePackage(file, bndl)
+		if errBP != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", file, errBP.Error())
+			exit(1)
+		}
+
+		if len(bndl.Truncated) > 0 {
+			fmt.Fprintf(os.Stderr, "%s is a -preview with truncated files, refusing to import it\n", file)
+			exit(1)
+		}
+
+		if bndl.PartOf != "" {
+			fmt.Fprintf(os.Stderr, "warning: skipping %s, it's a part of %s\n", file, bndl.PartOf)
+			continue
+		}
+
+		if len(bndl.Parts) > 0 {
+			if errJP := joinParts(filepath.Dir(file), bndl, *formatVersionMin); errJP != nil {
+				fmt.Fprintf(os.Stderr, "%s: %s\n", file, errJP.Error())
+				exit(1)
+			}
+		}
+
+		if *addPrefix != "" {
+			files := make(map[string]string, len(bndl.Files))
+			for file, content := range bndl.Files {
+				files[*addPrefix+file] = content
+			}
+
+			bndl.Files = files
+
+			for i := range bndl.Empty {
+				bndl.Empty[i] = *addPrefix + bndl.Empty[i]
+			}
+		}
+
+		if len(prefixRewrites) > 0 {
+			if errRP := rewritePrefixes(bndl, prefixRewrites); errRP != nil {
+				fmt.Fprintf(os.Stderr, "%s: %s\n", file, errRP.Error())
+				exit(1)
+			}
+		}
+
+		for _, file := range deleteFiles {
+			if _, ok := bndl.Files[file]; ok {
+				delete(bndl.Files, file)
+				continue
+			}
+
+			found := false
+			for j, empty := range bndl.Empty {
+				if empty == file {
+					bndl.Empty = append(bndl.Empty[:j], bndl.Empty[j+1:]...)
+					found = true
+					break
+				}
+			}
+
+			if !found {
+				fmt.Fprintf(os.Stderr, "warning: %s: %s isn't in the bundle anyway\n", name, file)
+			}
+		}
+
+		if *checkIncludes {
+			for _, dangling := range danglingIncludes(bndl) {
+				fmt.Fprintf(os.Stderr, "warning: %s: %s\n", name, dangling)
+			}
+		}
+
+		bundles = append(bundles, bndl)
+		names = append(names, name)
+	}
+
+	api := conn.connect()
+
+	// Before uploading anything, neither validating nor retrying must deploy untested config.
+	if *validateOnly || *verifyRetries > 0 {
+		flagName := "-validate-only"
+		if !*validateOnly {
+			flagName = "-verify-retries"
+		}
+
+		if errRI := requireInactiveStages(api, flagName); errRI != nil {
+			fmt.Fprintln(os.Stderr, errRI.Error())
+			exit(1)
+		}
+	}
+
+	var packages struct {
+		Results []stagedPackage `json:"results"`
+	}
+
+	if errSR := api.sendReq("GET", "/v1/config/packages", nil, &packages); errSR != nil {
+		fmt.Fprintln(os.Stderr, errSR.Error())
+		exit(1)
+	}
+
+	existing := map[string]bool{}
+	activeStages := map[string]string{}
+
+	for _, pkg := range packages.Results {
+		existing[pkg.Name] = true
+		activeStages[pkg.Name] = pkg.ActiveStage
+	}
+
+	invalid := false
+	var matched, discrepancies int
+	var unverified []string
+
+	for i, bndl := range bundles {
+		name := names[i]
+
+		if *checkMeta {
+			if bndl.Meta == nil || bndl.Meta.Stage == "" {
+				fmt.Fprintf(os.Stderr, "warning: %s: bundle has no stage meta data (see -with-meta)\n", name)
+			} else if active := activeStages[name]; active != bndl.Meta.Stage {
+				fmt.Fprintf(
+					os.Stderr, "warning: %s: bundle is from stage %q, but the active one is %q\n", name, bndl.Meta.Stage, active,
+				)
+			}
+		}
+
+		// Even if not listed, the package may exist, e.g. hidden by permission filters or just created in parallel.
+		if !existing[name] {
+			if errSR := api.sendReq("POST", "/v1/config/packages/"+url.PathEscape(name), nil, nil); errSR != nil {
+				if bhs, ok := errSR.(badHttpStatus); ok && packageExists(bhs) {
+					fmt.Fprintf(os.Stderr, "%s: package exists already, creating the stage anyway\n", name)
+				} else {
+					fmt.Fprintln(os.Stderr, errSR.Error())
+					exit(1)
+				}
+			}
+		}
+
+		files := make(map[string]string, len(bndl.Files)+len(bndl.Empty))
+		for file, content := range bndl.Files {
+			files[file] = content
+		}
+
+		for _, file := range bndl.Empty {
+			files[file] = ""
+		}
+
+		var created struct {
+			Results []struct {
+				Code    float64 `json:"code"`
+				Package string  `json:"package"`
+				Stage   string  `json:"stage"`
+				Status  string  `json:"status"`
+			} `json:"results"`
+		}
+
+		create := func(activate bool) {
+			// Creation and activation (after validation) are one request anyway.
+			errSR := api.sendReq("POST", "/v1/config/stages/"+url.PathEscape(name), &struct {
+				Files    map[string]string `json:"files"`
+				Activate bool              `json:"activate"`
+			}{files, activate}, &created)
+			if errSR != nil {
+				fmt.Fprintln(os.Stderr, errSR.Error())
+				exit(1)
+			}
+
+			for _, res := range created.Results {
+				fmt.Printf("created %s/%s\n", name, res.Stage)
+			}
+		}
+
+		verified := true
+		var ok, bad int
+
+		verify := func() {
+			verified = true
+			ok, bad = 0, 0
+
+			for _, res := range created.Results {
+				stageOK, stageBad, errVS := verifyStage(api, name, res.Stage, files)
+				if errVS != nil {
+					fmt.Fprintln(os.Stderr, errVS.Error())
+					exit(1)
+				}
+
+				for _, discrepancy := range stageBad {
+					fmt.Fprintf(os.Stderr, "%s/%s: %s\n", name, res.Stage, discrepancy)
+				}
+
+				fmt.Printf("verified %s/%s: %d of %d files match\n", name, res.Stage, stageOK, len(files))
+
+				ok += stageOK
+				bad += len(stageBad)
+				verified = verified && len(stageBad) < 1
+			}
+		}
+
+		deleteCreated := func() {
+			for _, res := range created.Results {
+				uri := "/v1/config/stages/" + url.PathEscape(name) + "/" + url.PathEscape(res.Stage)
+				if errSR := api.sendReq("DELETE", uri, nil, nil); errSR != nil {
+					fmt.Fprintln(os.Stderr, errSR.Error())
+					exit(1)
+				}
+
+				fmt.Printf("deleted %s/%s\n", name, res.Stage)
+			}
+		}
+
+		// With retries, only an upload already known to arrive intact gets activated, see below.
+		retrying := *verifyRetries > 0
+
+		for attempt := 0; ; attempt++ {
+			create(*activate && !retrying)
+
+			if !*verifyUpload {
+				break
+			}
+
+			verify()
+
+			if !verified && retrying {
+				deleteCreated()
+			}
+
+			if verified || attempt >= *verifyRetries {
+				break
+			}
+
+			fmt.Fprintf(os.Stderr, "%s: creating the stage again (retry %d of %d)\n", name, attempt+1, *verifyRetries)
+		}
+
+		// Icinga 2 can't activate existing stages, so upload the verified one again to be activated.
+		if verified && retrying && *activate {
+			deleteCreated()
+			create(true)
+			verify()
+
+			if !verified {
+				fmt.Fprintf(os.Stderr, "%s: the stage to be activated differs from the bundle, the master activates it anyway if valid\n", name)
+			}
+		}
+
+		// Only the last attempt counts.
+		matched += ok
+		discrepancies += bad
+
+		if !verified {
+			// The other packages may still be fine, report them all at the end.
+			unverified = append(unverified, name)
+			continue
+		}
+
+		for _, res := range created.Results {
+			if *validateOnly {
+				valid, errVl := validateStage(api, name, res.Stage, *keepStage)
+				if errVl != nil {
+					fmt.Fprintln(os.Stderr, errVl.Error())
+					exit(1)
+				}
+
+				if !valid {
+					invalid = true
+				}
+
+				continue
+			}
+
+			if *waitActive > 0 && *activate {
+				if errWA := waitForActive(api, name, res.Stage, *waitActive); errWA != nil {
+					fmt.Fprintln(os.Stderr, errWA.Error())
+					exit(1)
+				}
+
+				fmt.Printf("activated %s/%s\n", name, res.Stage)
+			}
+
+			if len(deleteFiles) > 0 {
+				var files struct {
+					Results []struct {
+						Name string `json:"name"`
+						Type string `json:"type"`
+					} `json:"results"`
+				}
+
+				errSR := api.sendReq(
+					"GET", "/v1/config/stages/"+url.PathEscape(name)+"/"+url.PathEscape(res.Stage),
+					nil, &files,
+				)
+				if errSR != nil {
+					fmt.Fprintln(os.Stderr, errSR.Error())
+					exit(1)
+				}
+
+				for _, file := range files.Results {
+					if deleted[file.Name] {
+						fmt.Fprintf(os.Stderr, "%s/%s still contains %s\n", name, res.Stage, file.Name)
+						exit(1)
+					}
+				}
+			}
+		}
+	}
+
+	if *verifyUpload {
+		fmt.Printf("upload verification: %d files match, %d discrepancies\n", matched, discrepancies)
+
+		if len(unverified) > 0 {
+			fmt.Fprintf(os.Stderr, "couldn't verify the upload of %s\n", strings.Join(unverified, ", "))
+			exit(1)
+		}
+	}
+
+	if invalid {
+		exit(1)
+	}
+}
+
+// verifyStage reads pkg's stage's files back and returns how many of them match files and the others' discrepancies.
+func verifyStage(api *apiClient, pkg, stage string, files map[string]string) (int, []string, error) {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	ok := 0
+	var bad []string
+
+	for _, name := range names {
+		var content []byte
+		if errSR := api.sendReq("GET", fileURI(pkg, stage, name, false), nil, &content); errSR != nil {
+			if bhs, isBHS := errSR.(badHttpStatus); isBHS && bhs.code == http.StatusNotFound {
+				bad = append(bad, name+" is missing")
+				continue
+			}
+
+			return 0, nil, errSR
+		}
+
+		expected := sha256.Sum256([]byte(files[name]))
+		actual := sha256.Sum256(content)
+
+		if actual == expected {
+			ok++
+		} else {
+			bad = append(bad, fmt.Sprintf(
+				"%s differs (sha256 %s, expected %s)", name, hex.EncodeToString(actual[:]), hex.EncodeToString(expected[:]),
+			))
+		}
+	}
+
+	return ok, bad, nil
+}
+
+// validationTimeout limits how long -validate-only waits for a stage's validation.
+const validationTimeout = 5 * time.Minute
+
+// validateStage waits for the master to validate pkg's stage, prints its startup.log and
+// (unless keep) deletes the stage. Icinga 2 writes the status file (exit code) last.
+func validateStage(api *apiClient, pkg, stage string, keep bool) (bool, error) {
+	deadline := time.Now().Add(validationTimeout)
+	var status []byte
+
+	for {
+		errSR := api.sendReq("GET", fileURI(pkg, stage, "status", false), nil, &status)
+		if errSR == nil {
+			break
+		}
+
+		if bhs, ok := errSR.(badHttpStatus); !ok || bhs.code != http.StatusNotFound {
+			return false, errSR
+		}
+
+		if time.Now().After(deadline) {
+			return false, fmt.Errorf("%s/%s wasn't validated within %s", pkg, stage, validationTimeout)
+		}
+
+		time.Sleep(time.Second)
+	}
+
+	var log []byte
+	if errSR := api.sendReq("GET", fileURI(pkg, stage, "startup.log", false), nil, &log); errSR != nil {
+		return false, errSR
+	}
+
+	os.Stdout.Write(log)
+
+	valid := strings.TrimSpace(string(status)) == "0"
+	if valid {
+		fmt.Printf("%s/%s is valid\n", pkg, stage)
+	} else {
+		fmt.Printf("%s/%s is invalid\n", pkg, stage)
+	}
+
+	if !keep {
+		uri := "/v1/config/stages/" + url.PathEscape(pkg) + "/" + url.PathEscape(stage)
+		if errSR := api.sendReq("DELETE", uri, nil, nil); errSR != nil {
+			return valid, errSR
+		}
+
+		fmt.Printf("deleted %s/%s\n", pkg, stage)
+	}
+
+	return valid, nil
+}
+
+// waitForActive polls the packages until stage is pkg's active one or timeout elapses.
+func waitForActive(api *apiClient, pkg, stage string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+
+	for {
+		var packages struct {
+			Results []stagedPackage `json:"results"`
+		}
+
+		if errSR := api.sendReq("GET", "/v1/config/packages", nil, &packages); errSR != nil {
+			return errSR
+		}
+
+		active := ""
+		for _, p := range packages.Results {
+			if p.Name == pkg {
+				active = p.ActiveStage
+				break
+			}
+		}
+
+		if active == stage {
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf(
+				"%s/%s didn't become active within %s, the active stage is still %q (see the stage's startup.log)",
+				pkg, stage, timeout, active,
+			)
+		}
+
+		time.Sleep(time.Second)
+	}
+}
+
+// rewritePrefixes renames bndl's files according to -rewrite-prefix and refuses
+// results which would escape the stage directory or collide with other files.
+func rewritePrefixes(bndl *bundle, rewrites [][2]string) error {
+	renamed := map[string]string{}
+	rename := func(file string) (string, error) {
+		newName := file
+		for _, rewrite := range rewrites {
+			if strings.HasPrefix(file, rewrite[0]) {
+				newName = rewrite[1] + strings.TrimPrefix(file, rewrite[0])
+				break
+			}
+		}
+
+		if newName == "" || path.IsAbs(newName) || path.Clean(newName) != newName ||
+			newName == ".." || strings.HasPrefix(newName, "../") {
+			return "", fmt.Errorf("-rewrite-prefix turns %q into the unsafe %q", file, newName)
+		}
+
+		if previous, ok := renamed[newName]; ok {
+			return "", fmt.Errorf("-rewrite-prefix turns both %q and %q into %q", previous, file, newName)
+		}
+
+		renamed[newName] = file
+		return newName, nil
+	}
+
+	files := make(map[string]string, len(bndl.Files))
+	for file, content := range bndl.Files {
+		newName, errRn := rename(file)
+		if errRn != nil {
+			return errRn
+		}
+
+		files[newName] = content
+	}
+
+	for i := range bndl.Empty {
+		newName, errRn := rename(bndl.Empty[i])
+		if errRn != nil {
+			return errRn
+		}
+
+		bndl.Empty[i] = newName
+	}
+
+	bndl.Files = files
+	return nil
+}
+
+// bundlePackage tells which package bndl read from file belongs to, usually PACKAGE.json's one.
+// -all-stages' PACKAGE/STAGE.json record it or, if older, at least their stage with -with-meta.
+func bundlePackage(file string, bndl *bundle) (string, error) {
+	if bndl.Package != "" {
+		return bndl.Package, nil
+	}
+
+	name, errPU := url.PathUnescape(strings.TrimSuffix(filepath.Base(file), ".json"))
+	if errPU != nil {
+		return "", errPU
+	}
+
+	if bndl.Meta != nil && bndl.Meta.Stage != "" && bndl.Meta.Stage == name {
+		dir, errAb := filepath.Abs(filepath.Dir(file))
+		if errAb != nil {
+			return "", errAb
+		}
+
+		return url.PathUnescape(filepath.Base(dir))
+	}
+
+	return name, nil
+}
+
+// packageExists tells whether creating a package failed just because it exists already.
+// Icinga 2 says so with HTTP 500 and the status "Package already exists.".
+func packageExists(bhs badHttpStatus) bool {
+	return bhs.code == http.StatusInternalServerError && strings.Contains(bhs.status, "already exists")
+}
+
+func readBundle(file string, minVersion int) (*bundle, error) {
+	if strings.HasSuffix(file, formatSuffixes["text"]) {
+		return nil, errors.New("-format text is for reading only, import the json one")
+	}
+
+	if strings.HasSuffix(file, mergedSuffix) {
+		return nil, errors.New("-merge-stages' output is for reading only, import one of -all-stages' PACKAGE/STAGE.json")
+	}
+
+	f, errOp := os.Open(file)
+	if errOp != nil {
+		return nil, errOp
+	}
+
+	defer f.Close()
+
+	bndl := &bundle{}
+	if errDc := json.NewDecoder(bufio.NewReader(f)).Decode(bndl); errDc != nil {
+		return nil, errDc
+	}
+
+	version := bndl.FormatVersion
+	if version == 0 {
+		version = 1
+	}
+
+	switch {
+	case version > extendedFormatVersion:
+		return nil, fmt.Errorf(
+			"bundle format version %d is newer than the supported %d, use a newer i2pkg", version, extendedFormatVersion,
+		)
+	case version < minVersion:
+		return nil, fmt.Errorf("bundle format version %d is older than -format-version-min %d", version, minVersion)
+	}
+
+	if errDB := decodeBundle(bndl); errDB != nil {
+		return nil, errDB
+	}
+
+	return bndl, nil
+}
+
+// danglingIncludes reports include(_recursive) directives with relative paths which match nothing in bndl.
+// Paths in <> refer to the Icinga 2 installation and absolute ones to the master's FS, so those aren't checked.
+// Neither are wildcard includes as Icinga 2 tolerates them matching nothing.
+func danglingIncludes(bndl *bundle) []string {
+	var present []string
+	for file := range bndl.Files {
+		present = append(present, file)
+	}
+
+	present = append(present, bndl.Empty...)
+	sort.Strings(present)
+
+	var dangling []string
+
+	for _, file := range present {
+		for _, match := range includeDirective.FindAllStringSubmatch(bndl.Files[file], -1) {
+			directive, target := match[1], match[2]
+			if path.IsAbs(target) || directive == "include" && strings.ContainsAny(target, "*?[") {
+				continue
+			}
+
+			target = path.Join(path.Dir(file), target)
+			found := false
+
+			for _, candidate := range present {
+				if directive == "include_recursive" {
+					found = strings.HasPrefix(candidate, target+"/")
+				} else {
+					found = candidate == target
+				}
+
+				if found {
+					break
+				}
+			}
+
+			if !found {
+				dangling = append(dangling, fmt.Sprintf("%s: %s %q matches no file", file, directive, match[2]))
+			}
+		}
+	}
+
+	return dangling
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// oldMaster mimics a master of the given version, which activates new stages regardless of activate=false.
+type oldMaster struct {
+	version string
+	uploads int32
+}
+
+func (om *oldMaster) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	switch {
+	case r.Method == "GET" && r.URL.Path == "/v1/status/IcingaApplication":
+		json.NewEncoder(w).Encode(map[string]interface{}{"results": []interface{}{map[string]interface{}{
+			"name": "IcingaApplication",
+			"status": map[string]interface{}{"icingaapplication": map[string]interface{}{
+				"app": map[string]interface{}{"version": om.version},
+			}},
+		}}})
+	case r.Method == "GET" && r.URL.Path == "/v1/config/packages":
+		w.Write([]byte(`{"results":[{"name":"pkg","active-stage":"old","stages":["old"]}]}`))
+	case r.Method == "POST":
+		atomic.AddInt32(&om.uploads, 1)
+		w.Write([]byte(`{"results":[{"code":200,"package":"pkg","stage":"activated-anyway"}]}`))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestRequireInactiveStages(t *testing.T) {
+	cases := []struct {
+		version string
+		ok      bool
+	}{
+		{"r2.12.3-1", false},
+		{"v2.11.0", false},
+		{"", false},
+		{"unknown", false},
+		{"v2.13.0", true},
+		{"r2.14.2-1", true},
+		{"3.0.0", true},
+	}
+
+	for _, c := range cases {
+		api := newTestAPI(t, &oldMaster{version: c.version}, ioutil.Discard)
+
+		if errRI := requireInactiveStages(api, "-validate-only"); (errRI == nil) != c.ok {
+			t.Errorf("version %q: requireInactiveStages() = %v, want ok = %v", c.version, errRI, c.ok)
+		}
+	}
+}
+
+// TestValidateOnlyOnOldMaster runs import -validate-only in a child process (as it exits)
+// against a master which would activate the stage and checks it refuses before uploading.
+func TestValidateOnlyOnOldMaster(t *testing.T) {
+	if args := os.Getenv("I2PKG_TEST_IMPORT"); args != "" {
+		importPackages(strings.Split(args, "\n"))
+		exit(0)
+	}
+
+	master := &oldMaster{version: "r2.12.3-1"}
+	srv := httptest.NewTLSServer(master)
+	defer srv.Close()
+
+	host, port, errSH := net.SplitHostPort(srv.Listener.Addr().String())
+	if errSH != nil {
+		t.Fatal(errSH)
+	}
+
+	dir, errTD := ioutil.TempDir("", "i2pkg-test-")
+	if errTD != nil {
+		t.Fatal(errTD)
+	}
+
+	defer os.RemoveAll(dir)
+
+	bundleFile := filepath.Join(dir, "pkg.json")
+	if errWF := ioutil.WriteFile(bundleFile, []byte(`{"files":{"conf.d/a.conf":"untested"}}`), 0644); errWF != nil {
+		t.Fatal(errWF)
+	}
+
+	ca := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}))
+	args := []string{"-host", host, "-port", port, "-cn", "example.com", "-user", "root", "-validate-only", bundleFile}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestValidateOnlyOnOldMaster$")
+	cmd.Env = append(os.Environ(), "I2PKG_TEST_IMPORT="+strings.Join(args, "\n"), "I2_CA="+ca, "I2_PASS=secret")
+
+	out, errRn := cmd.CombinedOutput()
+	if ee, ok := errRn.(*exec.ExitError); !ok || ee.ExitCode() != 1 {
+		t.Errorf("import -validate-only exited with %v, want 1:\n%s", errRn, out)
+	}
+
+	if !strings.Contains(string(out), "-validate-only requires Icinga 2 v2.13+") {
+		t.Errorf("import -validate-only didn't tell why it refused:\n%s", out)
+	}
+
+	if n := atomic.LoadInt32(&master.uploads); n > 0 {
+		t.Errorf("import -validate-only uploaded %d times to a master which would activate", n)
+	}
+}
+
+func TestBundlePackage(t *testing.T) {
+	cases := []struct {
+		file string
+		bndl bundle
+		pkg  string
+	}{
+		{"out/a%2Fb.json", bundle{}, "a/b"},
+		{"out/a.json", bundle{Meta: &bundleMeta{Stage: "master1-1600000000-1"}}, "a"},
+		{"out/a/master1-1600000000-1.json", bundle{Package: "a"}, "a"},
+		{"out/x%2Fy/master1-1600000000-1.json", bundle{Package: "x/y"}, "x/y"},
+		// -all-stages bundles not recording their package yet
+		{"out/x%2Fy/master1-1600000000-1.json", bundle{Meta: &bundleMeta{Stage: "master1-1600000000-1"}}, "x/y"},
+	}
+
+	for _, c := range cases {
+		if pkg, errBP := bundlePackage(c.file, &c.bndl); errBP != nil || pkg != c.pkg {
+			t.Errorf("bundlePackage(%q) = %q, %v, want %q", c.file, pkg, errBP, c.pkg)
+		}
+	}
+
+	wd, errGw := os.Getwd()
+	if errGw != nil {
+		t.Fatal(errGw)
+	}
+
+	if pkg, _ := bundlePackage("stage.json", &bundle{Meta: &bundleMeta{Stage: "stage"}}); pkg != filepath.Base(wd) {
+		t.Errorf("bundlePackage(%q) = %q, want the working directory %q", "stage.json", pkg, filepath.Base(wd))
+	}
+}
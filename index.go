@@ -0,0 +1,65 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+type indexEntry struct {
+	Package      string      `json:"package"`
+	Stage        string      `json:"stage"`
+	StageCreated string      `json:"stage-created,omitempty"`
+	Files        []indexFile `json:"files"`
+}
+
+type indexFile struct {
+	Name  string `json:"name"`
+	Bytes int    `json:"bytes"`
+	fileChecksum
+}
+
+// manifest lists bndl's files sorted by name.
+func manifest(bndl *bundle, checksumAlgo string) []indexFile {
+	files := make([]indexFile, 0, len(bndl.Files)+len(bndl.Empty)+len(bndl.listing))
+	files = append(files, bndl.listing...)
+
+	for name, content := range bndl.Files {
+		if full, ok := bndl.previewed[name]; ok {
+			files = append(files, full)
+		} else {
+			files = append(files, indexFile{name, len(content), newChecksum(checksumAlgo, []byte(content))})
+		}
+	}
+
+	for _, name := range bndl.Empty {
+		files = append(files, indexFile{name, 0, newChecksum(checksumAlgo, nil)})
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Name < files[j].Name
+	})
+
+	return files
+}
+
+// buildIndex lists the jobs' manifests sorted by package and stage.
+func buildIndex(jobs []stageJob, results []exportResult) []indexEntry {
+	index := make([]indexEntry, 0, len(jobs))
+	for i, job := range jobs {
+		if !results[i].capped {
+			entry := indexEntry{Package: job.pkg, Stage: job.stage, Files: results[i].manifest}
+			if created, ok := stageTime(job.stage); ok {
+				entry.StageCreated = created.UTC().Format(time.RFC3339)
+			}
+
+			index = append(index, entry)
+		}
+	}
+
+	sort.Slice(index, func(i, j int) bool {
+		a, b := &index[i], &index[j]
+		return a.Package < b.Package || a.Package == b.Package && a.Stage < b.Stage
+	})
+
+	return index
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+var errLocked = errors.New("locked")
+
+// lockRun takes the -lockfile lock for the rest of the run, waiting up to timeout for another instance to release it.
+// The file stays, it just contains the PID of the holder.
+func lockRun(path string, timeout time.Duration) {
+	f, errOp := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if errOp != nil {
+		fmt.Fprintln(os.Stderr, errOp.Error())
+		exit(1)
+	}
+
+	deadline := time.Now().Add(timeout)
+
+	for {
+		errTL := tryLock(f)
+		if errTL == nil {
+			break
+		}
+
+		if errTL != errLocked {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", path, errTL.Error())
+			exit(1)
+		}
+
+		if !time.Now().Before(deadline) {
+			holder := "another instance"
+			if pid, errRF := ioutil.ReadFile(path); errRF == nil && len(strings.TrimSpace(string(pid))) > 0 {
+				holder = "PID " + strings.TrimSpace(string(pid))
+			}
+
+			fmt.Fprintf(os.Stderr, "%s is locked by %s (see -lock-timeout)\n", path, holder)
+			exit(1)
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	if errTr := f.Truncate(0); errTr == nil {
+		fmt.Fprintf(f, "%d\n", os.Getpid())
+	}
+
+	atExit = append(atExit, func() {
+		f.Close()
+	})
+}
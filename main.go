@@ -3,9 +3,8 @@ package main
 import (
 	"bufio"
 	"bytes"
-	"crypto/tls"
-	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -13,245 +12,2228 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"runtime/pprof"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-type httpLogger struct {
-	next http.RoundTripper
+// bundleFormatVersion is written into bundles, extendedFormatVersion into split ones and previews which older readers
+// must not take for complete bundles. The latter is also the newest one readBundle accepts.
+// Bundles from before format versions count as version 1.
+const (
+	bundleFormatVersion   = 1
+	extendedFormatVersion = 2
+)
+
+type bundle struct {
+	FormatVersion int               `json:"format-version,omitempty"`
+	Files         map[string]string `json:"files"`
+	Empty         []string          `json:"empty,omitempty"`
+	Symlinks      map[string]string `json:"symlinks,omitempty"`
+	Meta          *bundleMeta       `json:"meta,omitempty"`
+	// -split-threshold's part files (instead of Files) or the file this is a part of
+	Parts  []string `json:"parts,omitempty"`
+	PartOf string   `json:"part-of,omitempty"`
+	// files -preview cut off
+	Truncated []string `json:"truncated,omitempty"`
+	// exported from a stage that wasn't the package's active one (e.g. -include-unactivated)
+	Inactive bool `json:"inactive,omitempty"`
+	// -all-stages' package as its PACKAGE/STAGE.json is named after the stage
+	Package string `json:"package,omitempty"`
+	// -encode's mode and the files it base64-encoded
+	Encoding string   `json:"encoding,omitempty"`
+	Base64   []string `json:"base64,omitempty"`
+
+	// -exclude-content's findings instead of Files
+	listing []indexFile
+	// -preview's full sizes and checksums of Truncated
+	previewed map[string]indexFile
+	// -keep-empty-dirs' directories for -format dir
+	dirs []string
+}
+
+type bundleMeta struct {
+	Stage        string `json:"stage,omitempty"`
+	StageCreated string `json:"stage-created,omitempty"`
+	Host         string `json:"host,omitempty"`
+	Port         string `json:"port,omitempty"`
+	CN           string `json:"cn,omitempty"`
+	Exported     string `json:"exported,omitempty"`
+	Version      string `json:"version,omitempty"`
+}
+
+type configPackage struct {
+	ActiveStage string `json:"active-stage"`
+	Name        string `json:"name"`
+}
+
+type fileResult struct {
+	Package string `json:"package"`
+	Stage   string `json:"stage,omitempty"`
+	Name    string `json:"name"`
+	Bytes   int    `json:"bytes"`
+	fileChecksum
+	Status string `json:"status"`
+}
+
+// stageJob is a stage to export.
+type stageJob struct {
+	pkg   string
+	stage string
 }
 
-var _ http.RoundTripper = httpLogger{}
+type exportResult struct {
+	log    bytes.Buffer
+	bundle *bundle
+	err    error
+	done   chan struct{}
+	files  int
+	bytes  int
+	meta   *bundleMeta
+	paths  []string
+	// not exported due to -max-total-bytes
+	capped bool
 
-func (hl httpLogger) RoundTrip(request *http.Request) (*http.Response, error) {
-	fmt.Printf("%s %s\n", request.Method, request.URL.String())
-	return hl.next.RoundTrip(request)
+	manifest []indexFile
 }
 
-type closableReader struct {
-	r io.Reader
+var errCapped = errors.New("-max-total-bytes reached")
+
+// summaryEntry is a package's (or stage's) line of the export summary for -o json.
+type summaryEntry struct {
+	Package      string   `json:"package"`
+	Stage        string   `json:"stage"`
+	StageCreated string   `json:"stage-created,omitempty"`
+	Files        int      `json:"files"`
+	Bytes        int      `json:"bytes"`
+	Paths        []string `json:"paths,omitempty"`
+	Capped       bool     `json:"not-exported,omitempty"`
 }
 
-var _ io.ReadCloser = closableReader{}
+type stringList []string
 
-func (cr closableReader) Read(p []byte) (int, error) {
-	return cr.r.Read(p)
+var _ flag.Value = (*stringList)(nil)
+
+func (sl *stringList) String() string {
+	return strings.Join(*sl, ",")
 }
 
-func (closableReader) Close() error {
+func (sl *stringList) Set(s string) error {
+	*sl = append(*sl, s)
 	return nil
 }
 
-type badHttpStatus struct {
-	code int
+// syncWriter serializes concurrent writes.
+type syncWriter struct {
+	mtx sync.Mutex
+	w   io.Writer
+}
+
+var _ io.Writer = (*syncWriter)(nil)
+
+func (sw *syncWriter) Write(p []byte) (int, error) {
+	sw.mtx.Lock()
+	defer sw.mtx.Unlock()
+
+	return sw.w.Write(p)
+}
+
+var atExit []func()
+var exitStatus int
+var exitMtx sync.Mutex
+
+// exit runs the atExit hooks (once, even if called concurrently) and exits with exitStatus which they may change.
+func exit(code int) {
+	exitMtx.Lock()
+	exitStatus = code
+
+	for i := len(atExit) - 1; i >= 0; i-- {
+		atExit[i]()
+	}
+
+	os.Exit(exitStatus)
 }
 
-var _ error = badHttpStatus{}
+func startProfile(profile string) {
+	switch profile {
+	case "":
+	case "mem":
+		atExit = append(atExit, func() {
+			f, errCr := os.Create("i2pkg-mem.pprof")
+			if errCr != nil {
+				fmt.Fprintln(os.Stderr, errCr.Error())
+				return
+			}
+
+			defer f.Close()
+
+			runtime.GC()
+
+			if errWH := pprof.WriteHeapProfile(f); errWH != nil {
+				fmt.Fprintln(os.Stderr, errWH.Error())
+			}
+		})
+	default:
+		if profile == "cpu" {
+			profile = "i2pkg-cpu.pprof"
+		}
+
+		f, errCr := os.Create(profile)
+		if errCr != nil {
+			fmt.Fprintln(os.Stderr, errCr.Error())
+			exit(1)
+		}
+
+		if errSC := pprof.StartCPUProfile(f); errSC != nil {
+			fmt.Fprintln(os.Stderr, errSC.Error())
+			exit(1)
+		}
 
-func (bhs badHttpStatus) Error() string {
-	return fmt.Sprintf("HTTP %d", bhs.code)
+		atExit = append(atExit, func() {
+			pprof.StopCPUProfile()
+			f.Close()
+		})
+	}
 }
 
 func main() {
-	host := flag.String("host", "", "HOST")
-	port := flag.String("port", "5665", "PORT")
-	ca := flag.String("ca", "", "FILE")
-	cn := flag.String("cn", "", "COMMON_NAME")
-	user := flag.String("user", "", "USERNAME")
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "bench":
+			bench(os.Args[2:])
+			return
+		case "cat":
+			catFile(os.Args[2:])
+			return
+		case "cas-restore":
+			casRestore(os.Args[2:])
+			return
+		case "check-ha":
+			checkHA(os.Args[2:])
+			return
+		case "compare-envs":
+			compareEnvs(os.Args[2:])
+			return
+		case "compare-remote":
+			compareRemote(os.Args[2:])
+			return
+		case "events":
+			events(os.Args[2:])
+			return
+		case "import":
+			importPackages(os.Args[2:])
+			return
+		case "prune":
+			prune(os.Args[2:])
+			return
+		case "size":
+			size(os.Args[2:])
+			return
+		case "whoami":
+			whoami(os.Args[2:])
+			return
+		}
+	}
+
+	conn := addConnFlags(flag.CommandLine)
+	skipEmpty := flag.Bool("skip-empty", false, "omit zero-byte files' content (they're still listed as \"empty\")")
+	concurrency := flag.Int("concurrency", 1, "`NUMBER` of packages to export in parallel")
+	outputWriters := flag.Int(
+		"parallel-output-writers", 0,
+		"write at most `NUMBER` packages' files at once, e.g. to stay below the open files limit (0: as many as -concurrency)",
+	)
+	preferArchive := flag.Bool(
+		"prefer-archive", false,
+		"ask the master for each stage as one tarball and fall back to per-file downloads if it just lists the files",
+	)
+	fileConcurrency := flag.Int(
+		"content-max-concurrency-per-package", 1, "`NUMBER` of files to fetch in parallel per package (in addition to -concurrency)",
+	)
+	ordered := flag.Bool(
+		"ordered", false,
+		"emit output in the server's package order despite -concurrency (buffers finished packages in memory until it's their turn)",
+	)
+	outSingle := flag.String("out-single", "", "write all packages into one JSON `FILE` (- for stdout, implies -quiet; FIFOs work, too)")
+	casDir := flag.String(
+		"cas-dir", "",
+		"write each distinct file content once into the content-addressed store `DIRECTORY` (shared by packages and runs) "+
+			"and a manifest of this export - cas-restore turns it back into bundles",
+	)
+	combinedFile := flag.String(
+		"combined", "",
+		"like -out-single, but write each package into `FILE` (with its active stage) as soon as it's downloaded, not all at the end",
+	)
+	quiet := flag.Bool("quiet", false, "don't log requests")
+	stripPrefix := flag.String("strip-path-prefix", "", "remove `PREFIX` from recorded file names (import re-adds it)")
+	resultsFile := flag.String(
+		"results", "",
+		"write every file's package, name, size, checksum and status as JSON into `FILE` (- or a FIFO work, too), "+
+			"keeping an existing regular FILE's entries of packages not exported this time",
+	)
+	checksumsReset := flag.Bool("checksums-reset", false, "overwrite -results instead of merging into it")
+	htmlEscape := flag.Bool("html-escape", false, "escape <, > and & in written JSON")
+	startAfter := flag.String(
+		"start-after", "", "skip the packages up to and including `NAME` in the master's order, e.g. to resume a failed run",
+	)
+	maxPackages := flag.Int("max-packages", 0, "abort if there are more than `NUMBER` packages to export (0: unlimited)")
+	force := flag.Bool("force", false, "export anyway if -max-packages is exceeded")
+	packageList := flag.String(
+		"package-list", "", "export only the packages named in `FILE`, one per line (blank lines and lines starting with # ignored)",
+	)
+	strictList := flag.Bool("strict-list", false, "fail instead of warning about -package-list entries not found on the master")
+	endpointStyle := flag.String(
+		"content-endpoint-style", "path",
+		"pass file names to the files endpoint as path segments (path) or as ?path= (query, for masters/proxies choking on those)",
+	)
+	embedMeta := flag.Bool(
+		"embed-meta", true,
+		"record host, port, CN, export time and i2pkg version in every bundle (-embed-meta=false for reproducible output)",
+	)
+	withMeta := flag.Bool("with-meta", false, "record the stage (i.e. deployment) each package was exported from")
+	allStages := flag.Bool("all-stages", false, "export every stage of each package into PACKAGE/STAGE.json (or PACKAGE/STAGE/ etc. for other -format)")
+	mergeStages := flag.Bool(
+		"merge-stages", false,
+		"fetch every stage of each package, but write the union of their files into PACKAGE"+mergedSuffix+
+			" listing per file which stages contain which version (for reading only, not for import)",
+	)
+	noActiveRequired := flag.Bool(
+		"no-active-stage-required", false,
+		"also export packages without an active stage (their newest stage or, with -all-stages, all of them)",
+	)
+	includeUnactivated := flag.Bool(
+		"include-unactivated", false, "same as -no-active-stage-required, such bundles are marked as \"inactive\"",
+	)
+	outTemplate := flag.String(
+		"out-template", "",
+		"write the per-package files into the directory `TEMPLATE` (Go text/template with .Time and .Host), "+
+			"e.g. 'backups/{{.Time.Format \"2006-01-02\"}}'",
+	)
+	namespaceByHost := flag.Bool(
+		"namespace-by-host", false,
+		"write the per-package files into a subdirectory (of -out-template) named after -host, e.g. for several masters in one repository",
+	)
+	namespaceByCN := flag.Bool("namespace-by-cn", false, "like -namespace-by-host, but named after -cn")
+	keep := flag.Int("keep", 0, "after a successful export, delete all but the `NUMBER` newest directories matching -out-template")
+	hookCommand := flag.String("post-hook", "", "run `COMMAND` after each package or the whole run (see -hook-scope)")
+	hookScope := flag.String("hook-scope", "package", "run -post-hook per package or once per run")
+	hookStrict := flag.Bool("hook-strict", false, "fail if -post-hook fails")
+	format := flag.String(
+		"format", "json",
+		"write each package as a JSON file (json), a directory tree (dir), a tarball (targz) "+
+			"and/or one text document for reading, not import (text), e.g. json,dir - all from one download",
+	)
+	fileMode := flag.String("file-mode", "0644", "octal `MODE` of files written by -format dir or targz")
+	dirMode := flag.String("dir-mode", "0755", "octal `MODE` of directories created by -format dir or targz")
+	keepEmptyDirs := flag.Bool("keep-empty-dirs", false, "let -format dir also create the stages' directories without files")
+	gitkeep := flag.Bool("gitkeep", false, "put an empty .gitkeep into -keep-empty-dirs' directories, so git tracks them")
+	outputUID := flag.Int("output-uid", -1, "make user `ID` own all written files and directories (as root, -1: don't change)")
+	outputGID := flag.Int("output-gid", -1, "make group `ID` own all written files and directories (as root, -1: don't change)")
+	profile := flag.String(
+		"profile", "", "write a pprof profile: cpu (i2pkg-cpu.pprof), mem (i2pkg-mem.pprof) or a CPU profile into `FILE`",
+	)
+	batchFile := flag.String(
+		"batch-file", "",
+		"export each master in the JSON `FILE` listing name, host, port, ca, cn, user, outdir (default: name) "+
+			"and password-ref (env var) instead of -host etc. (not with single-file outputs like -out-single or with -git-commit)",
+	)
+	batchConcurrency := flag.Int("batch-concurrency", 1, "`NUMBER` of -batch-file masters to export in parallel")
+	var excludeGlobs stringList
+	flag.Var(
+		&excludeGlobs, "exclude-file-glob",
+		"skip files matching `PATTERN` (repeatable), e.g. secrets/* or **/*.key (or just *.key for the base name)",
+	)
+	var zones stringList
+	flag.Var(
+		&zones, "zone",
+		"export only the files deployed to the Icinga 2 zone `NAME`, i.e. zones.d/NAME/... (repeatable) - "+
+			"filtered here as the config package endpoints don't take filter expressions (only /v1/objects does)",
+	)
+	var fileRegexes, fileRegexExcludes stringList
+	flag.Var(&fileRegexes, "file-regex", "export only files whose path matches `REGEXP` (repeatable, any one suffices)")
+	flag.Var(&fileRegexExcludes, "file-regex-exclude", "skip files whose path matches `REGEXP` (repeatable)")
+	extInclude := flag.String(
+		"ext-include", "",
+		"export only files with one of the comma-separated `EXTENSIONS` (case-insensitive, e.g. conf,json) - "+
+			"a file must pass all filters, these are checked first, then -exclude-file-glob, then -file-regex(-exclude)",
+	)
+	extExclude := flag.String("ext-exclude", "", "skip files with one of the comma-separated `EXTENSIONS`, e.g. log,tmp")
+	checksumAlgo := flag.String("checksum-algo", "sha256", "hash files for -results and -index with sha256 or sha512")
+	index := flag.Bool(
+		"index", false, "also write index.json listing all exported packages' stages and files' names, sizes and checksums",
+	)
+	excludeContent := flag.Bool(
+		"exclude-content", false,
+		"don't download files, just write index.json with their names and sizes "+
+			"(checksums only if the master sends Digest headers on HEAD, which Icinga 2 itself doesn't)",
+	)
+	connectRetry := flag.Duration(
+		"connect-retry", 0, "keep retrying the initial package listing for up to `DURATION` while the master is unreachable",
+	)
+	minPackages := flag.Int("min-packages", 0, "fail if fewer than `NUMBER` packages were exported, e.g. from a partially broken master")
+	minFiles := flag.Int("min-files", 0, "fail if fewer than `NUMBER` files were exported in total")
+	sortRecent := flag.Bool("sort-recent", false, "list the most recently created stages first in the summary")
+	gitAttributes := flag.Bool(
+		"git-attributes", false, "also write a .gitattributes (LF text, binary files) and a .gitignore (temporary files) into the output directory",
+	)
+	gitCommitFlag := flag.Bool(
+		"git-commit", false, "commit the output directory (inside a git working tree) afterwards, if anything changed",
+	)
+	gitPush := flag.String("git-push", "", "push -git-commit's commit to `REMOTE`")
+	onDuplicate := flag.String(
+		"on-duplicate", "error",
+		"if two files get the same recorded name (e.g. due to -strip-path-prefix), fail (error), keep the first (skip) or the last one (overwrite)",
+	)
+	onStageChange := flag.String(
+		"on-stage-change", "warn",
+		"if a package's active stage changed while exporting it (by a deployment), warn, fetch the new one (refetch), fail "+
+			"or don't even check (ignore) - either way a package's files come from one stage only",
+	)
+	splitThreshold := flag.Int(
+		"split-threshold", 0,
+		"write JSON bundles with more than `BYTES` of content as PACKAGE.partN.json files referenced by PACKAGE.json (0: never)",
+	)
+	listStagesOf := flag.String("list-stages", "", "just print the stages of the package `NAME` with their file counts")
+	catalogFile := flag.String(
+		"catalog", "",
+		"just write the packages with their active stage and all stages with file counts as JSON into `FILE` (- for stdout), "+
+			"no file contents",
+	)
+	listJSON := flag.Bool("json", false, "same as -o json")
+	output := addOutputFlag(flag.CommandLine)
+	reportMissingOf := flag.String(
+		"report-missing", "",
+		"just compare the active stages' files with the index.json or -results `FILE` of a previous export, print -removed and +added ones "+
+			"and fail if any vanished",
+	)
+	preview := flag.Int(
+		"preview", 0, "keep only the first `BYTES` of each file for a quick look (not for import, -index and -results keep full sizes)",
+	)
+	maxTotalBytes := flag.Int64(
+		"max-total-bytes", 0,
+		"stop downloading after `BYTES` of file content in total, write the packages complete by then and exit with 3 (0: unlimited)",
+	)
+	encode := flag.String(
+		"encode", "raw",
+		"store file contents in JSON as is (raw, binary ones get mangled), base64-encoded if binary (auto) or always (base64)",
+	)
+	lockfile := flag.String(
+		"lockfile", "", "hold an exclusive lock on `FILE` while running and fail if another run holds it (see -lock-timeout)",
+	)
+	lockTimeout := flag.Duration("lock-timeout", 0, "wait up to `DURATION` for another run to release -lockfile")
+	printCfg := flag.Bool("print-config", false, "print the effective flags as JSON (secrets redacted) and exit")
 
 	flag.Parse()
 
-	if *host == "" {
-		fmt.Fprintln(os.Stderr, "-host missing")
-		os.Exit(2)
+	if *printCfg {
+		printConfig(flag.CommandLine)
+		exit(0)
+	}
+
+	// Before -batch-file, so its runs don't lock each other out
+	if *lockfile != "" {
+		lockRun(*lockfile, *lockTimeout)
 	}
 
-	if *port == "" {
-		fmt.Fprintln(os.Stderr, "-port missing")
-		os.Exit(2)
+	if *batchFile != "" {
+		runBatch(*batchFile, *batchConcurrency)
+		exit(0)
 	}
 
-	if *ca == "" {
-		fmt.Fprintln(os.Stderr, "-ca missing")
-		os.Exit(2)
+	conn.validate()
+
+	if *endpointStyle != "path" && *endpointStyle != "query" {
+		fmt.Fprintln(os.Stderr, "-content-endpoint-style must be path or query")
+		exit(2)
 	}
 
-	if *cn == "" {
-		fmt.Fprintln(os.Stderr, "-cn missing")
-		os.Exit(2)
+	if *keep < 0 {
+		fmt.Fprintln(os.Stderr, "-keep must not be negative")
+		exit(2)
 	}
 
-	if *user == "" {
-		fmt.Fprintln(os.Stderr, "-user missing")
-		os.Exit(2)
+	if *keep > 0 && *outTemplate == "" {
+		fmt.Fprintln(os.Stderr, "-keep requires -out-template")
+		exit(2)
 	}
 
-	pass := os.Getenv("I2_PASS")
-	if pass == "" {
-		fmt.Fprintln(os.Stderr, "$I2_PASS missing")
-		os.Exit(2)
+	exportTime := time.Now()
+
+	outDir := ""
+	if *outTemplate != "" {
+		dir, errOD := outputDir(*outTemplate, *conn.host, exportTime)
+		if errOD != nil {
+			fmt.Fprintf(os.Stderr, "-out-template: %s\n", errOD.Error())
+			exit(2)
+		}
+
+		outDir = dir
 	}
 
-	cas := x509.NewCertPool()
+	// -keep prunes only the same namespace's exports.
+	pruneTemplate := *outTemplate
+
+	if *namespaceByHost || *namespaceByCN {
+		if *namespaceByHost && *namespaceByCN {
+			fmt.Fprintln(os.Stderr, "-namespace-by-host and -namespace-by-cn are mutually exclusive")
+			exit(2)
+		}
+
+		name := hostName(*conn.host)
+		if *namespaceByCN {
+			name = *conn.cn
+		}
+
+		namespace := safeDirName(name)
+		if namespace == "" {
+			fmt.Fprintf(os.Stderr, "can't name a directory after %q\n", name)
+			exit(2)
+		}
+
+		outDir = filepath.Join(outDir, namespace)
+		pruneTemplate = filepath.Join(pruneTemplate, namespace)
+	}
 
+	var formats []string
 	{
-		pem, errRF := ioutil.ReadFile(*ca)
-		if errRF != nil {
-			fmt.Fprintln(os.Stderr, errRF.Error())
-			os.Exit(1)
+		seen := map[string]bool{}
+		for _, f := range strings.Split(*format, ",") {
+			if _, ok := formatSuffixes[f]; !ok {
+				fmt.Fprintln(os.Stderr, "-format must be a comma-separated list of json, dir, targz and text")
+				exit(2)
+			}
+
+			if !seen[f] {
+				seen[f] = true
+				formats = append(formats, f)
+			}
+		}
+	}
+
+	if *outSingle != "" && (len(formats) > 1 || formats[0] != "json" && formats[0] != "text") {
+		fmt.Fprintln(os.Stderr, "-out-single works only with -format json or text")
+		exit(2)
+	}
+
+	if *mergeStages {
+		if len(formats) > 1 || formats[0] != "json" || *outSingle != "" || *combinedFile != "" || *casDir != "" ||
+			*index || *splitThreshold > 0 {
+			fmt.Fprintln(
+				os.Stderr,
+				"-merge-stages works only with -format json and without -out-single, -combined, -cas-dir, -index and -split-threshold",
+			)
+			exit(2)
+		}
+
+		*allStages = true
+		fmt.Fprintln(os.Stderr, "warning: -merge-stages' output is for reading only, not for import")
+	}
+
+	if *casDir != "" {
+		switch {
+		case len(formats) > 1 || formats[0] != "json":
+			fmt.Fprintln(os.Stderr, "-cas-dir replaces -format")
+			exit(2)
+		case *outSingle != "" || *combinedFile != "" || *index || *splitThreshold > 0 || *allStages:
+			fmt.Fprintln(os.Stderr, "-cas-dir works only without -out-single, -combined, -index, -split-threshold and -all-stages")
+			exit(2)
+		// The manifest can't tell truncated or missing contents, cas-restore would make importable bundles of them.
+		case *preview > 0 || *excludeContent:
+			fmt.Fprintln(os.Stderr, "-cas-dir works only without -preview and -exclude-content")
+			exit(2)
+		}
+	}
+
+	if *combinedFile != "" {
+		if len(formats) > 1 || formats[0] != "json" || *outSingle != "" || *index || *splitThreshold > 0 {
+			fmt.Fprintln(os.Stderr, "-combined works only with -format json and without -out-single, -index or -split-threshold")
+			exit(2)
+		}
+
+		if *combinedFile == "-" {
+			*quiet = true
+		}
+	}
+
+	for _, glob := range excludeGlobs {
+		if !validGlob(glob) {
+			fmt.Fprintf(os.Stderr, "-exclude-file-glob: bad pattern %q\n", glob)
+			exit(2)
+		}
+	}
+
+	includeRegexes := compileRegexes("-file-regex", fileRegexes)
+	excludeRegexes := compileRegexes("-file-regex-exclude", fileRegexExcludes)
+
+	if _, ok := checksumAlgos[*checksumAlgo]; !ok {
+		fmt.Fprintln(os.Stderr, "-checksum-algo must be sha256 or sha512")
+		exit(2)
+	}
+
+	if *excludeContent {
+		if *outSingle != "" || *preferArchive {
+			fmt.Fprintln(os.Stderr, "-exclude-content is incompatible with -out-single and -prefer-archive")
+			exit(2)
+		}
+
+		*index = true
+	}
+
+	switch *onDuplicate {
+	case "error", "skip", "overwrite":
+	default:
+		fmt.Fprintln(os.Stderr, "-on-duplicate must be error, skip or overwrite")
+		exit(2)
+	}
+
+	if *includeUnactivated {
+		*noActiveRequired = true
+	}
+
+	switch *onStageChange {
+	case "warn", "refetch", "fail", "ignore":
+	default:
+		fmt.Fprintln(os.Stderr, "-on-stage-change must be warn, refetch, fail or ignore")
+		exit(2)
+	}
+
+	if *preview < 0 {
+		fmt.Fprintln(os.Stderr, "-preview must not be negative")
+		exit(2)
+	}
+
+	if *preview > 0 {
+		for _, f := range formats {
+			if f != "json" {
+				fmt.Fprintln(os.Stderr, "-preview works only with -format json (the other formats can't mark truncated files)")
+				exit(2)
+			}
+		}
+
+		if *excludeContent {
+			fmt.Fprintln(os.Stderr, "-preview and -exclude-content are mutually exclusive")
+			exit(2)
 		}
 
-		if !cas.AppendCertsFromPEM(pem) {
-			fmt.Fprintln(os.Stderr, "bad CA cert")
-			os.Exit(1)
+		fmt.Fprintln(os.Stderr, "warning: -preview truncates files, its bundles are only for a look, not for import")
+	}
+
+	switch *encode {
+	case "raw", "auto", "base64":
+	default:
+		fmt.Fprintln(os.Stderr, "-encode must be raw, auto or base64")
+		exit(2)
+	}
+
+	if *splitThreshold < 0 {
+		fmt.Fprintln(os.Stderr, "-split-threshold must not be negative")
+		exit(2)
+	}
+
+	if *listJSON {
+		*output = "json"
+	}
+
+	validateOutput(*output)
+
+	if *output == "json" && (*outSingle == "-" || *combinedFile == "-") {
+		fmt.Fprintln(os.Stderr, "-o json needs stdout, so -out-single and -combined can't use it")
+		exit(2)
+	}
+
+	if *gitPush != "" && !*gitCommitFlag {
+		fmt.Fprintln(os.Stderr, "-git-push requires -git-commit")
+		exit(2)
+	}
+
+	if *index && *outSingle != "" {
+		fmt.Fprintln(os.Stderr, "-index and -out-single are mutually exclusive")
+		exit(2)
+	}
+
+	if *keepEmptyDirs && *preferArchive {
+		fmt.Fprintln(os.Stderr, "-keep-empty-dirs is incompatible with -prefer-archive")
+		exit(2)
+	}
+
+	if *gitkeep && !*keepEmptyDirs {
+		fmt.Fprintln(os.Stderr, "-gitkeep requires -keep-empty-dirs")
+		exit(2)
+	}
+
+	modes := treeModes{gitkeep: *gitkeep}
+	for _, mode := range []struct {
+		flag  string
+		value string
+		mode  *os.FileMode
+	}{{"-file-mode", *fileMode, &modes.file}, {"-dir-mode", *dirMode, &modes.dir}} {
+		perm, errPU := strconv.ParseUint(mode.value, 8, 32)
+		if errPU != nil || perm&^uint64(os.ModePerm) != 0 {
+			fmt.Fprintf(os.Stderr, "%s must be an octal permission mode like 0644\n", mode.flag)
+			exit(2)
 		}
+
+		*mode.mode = os.FileMode(perm)
 	}
 
-	client := &http.Client{Transport: httpLogger{&http.Transport{
-		TLSClientConfig: &tls.Config{RootCAs: cas, ServerName: *cn},
-	}}}
+	setOutputOwner(*outputUID, *outputGID)
 
-	req := &http.Request{
-		URL:    &url.URL{Scheme: "https", Host: *host + ":" + *port},
-		Header: http.Header{},
-		//Header: http.Header{"Accept": []string{"application/json"}},
+	if *hookScope != "package" && *hookScope != "run" {
+		fmt.Fprintln(os.Stderr, "-hook-scope must be package or run")
+		exit(2)
 	}
 
-	req.SetBasicAuth(*user, pass)
+	startProfile(*profile)
+
+	if *concurrency < 1 {
+		fmt.Fprintln(os.Stderr, "-concurrency must be positive")
+		exit(2)
+	}
+
+	if *outputWriters < 0 {
+		fmt.Fprintln(os.Stderr, "-parallel-output-writers must not be negative")
+		exit(2)
+	}
+
+	if *fileConcurrency < 1 {
+		fmt.Fprintln(os.Stderr, "-content-max-concurrency-per-package must be positive")
+		exit(2)
+	}
+
+	var listed map[string]bool
+	if *packageList != "" {
+		names, errRL := readPackageList(*packageList)
+		if errRL != nil {
+			fmt.Fprintln(os.Stderr, errRL.Error())
+			exit(1)
+		}
+
+		listed = map[string]bool{}
+		for _, name := range names {
+			listed[name] = true
+		}
+	}
+
+	var logOut io.Writer = os.Stdout
+	if *quiet || *outSingle == "-" {
+		logOut = ioutil.Discard
+	} else if *listStagesOf != "" || *reportMissingOf != "" || *output == "json" || *catalogFile == "-" {
+		logOut = os.Stderr
+	}
+
+	api := conn.connect().withLog(logOut)
 
 	var packages struct {
-		Results []struct {
-			ActiveStage string `json:"active-stage"`
-			Name        string `json:"name"`
-		} `json:"results"`
+		Results []stagedPackage `json:"results"`
 	}
 
-	if errSR := sendReq(client, req, "GET", "/v1/config/packages", nil, &packages); errSR != nil {
+	errSR := retryConnect(*connectRetry, func() error {
+		return api.sendReq("GET", "/v1/config/packages", nil, &packages)
+	})
+	if errSR != nil {
 		fmt.Fprintln(os.Stderr, errSR.Error())
-		os.Exit(1)
+		exit(1)
 	}
 
+	if *listStagesOf != "" {
+		listStages(api, packages.Results, *listStagesOf, *output)
+		exit(0)
+	}
+
+	if *catalogFile != "" {
+		writeCatalog(api, packages.Results, listed, *conn.host, *catalogFile, *htmlEscape)
+		exit(0)
+	}
+
+	if *reportMissingOf != "" {
+		reportMissing(api, packages.Results, *reportMissingOf, *stripPrefix, *output)
+	}
+
+	var pkgs []string
+	var jobs []stageJob
+	activeStages := map[string]string{}
+	started := *startAfter == ""
+	skipped := 0
+
 	for _, pkg := range packages.Results {
-		if pkg.Name != "" && pkg.ActiveStage != "" /*&& !strings.HasPrefix(pkg.Name, "_")*/ {
-			var files struct {
-				Results []struct {
-					Name string `json:"name"`
-					Type string `json:"type"`
-				} `json:"results"`
-			}
-
-			{
-				errSR := sendReq(
-					client, req, "GET", "/v1/config/stages/"+url.PathEscape(pkg.Name)+"/"+url.PathEscape(pkg.ActiveStage),
-					nil, &files,
-				)
-				if errSR != nil {
-					fmt.Fprintln(os.Stderr, errSR.Error())
-					os.Exit(1)
+		if pkg.Name == "" /*|| strings.HasPrefix(pkg.Name, "_")*/ {
+			continue
+		}
+
+		if listed != nil {
+			if _, ok := listed[pkg.Name]; !ok {
+				continue
+			}
+
+			listed[pkg.Name] = false
+		}
+
+		if pkg.ActiveStage == "" && (!*noActiveRequired || len(pkg.Stages) < 1) {
+			if listed != nil {
+				fmt.Fprintf(os.Stderr, "warning: -package-list: %s has no active stage\n", pkg.Name)
+			}
+
+			continue
+		}
+
+		if !started {
+			started = pkg.Name == *startAfter
+			skipped++
+			continue
+		}
+
+		if pkg.ActiveStage == "" {
+			fmt.Fprintf(logOut, "including %s despite no active stage (-no-active-stage-required)\n", pkg.Name)
+		}
+
+		pkgs = append(pkgs, pkg.Name)
+		activeStages[pkg.Name] = pkg.ActiveStage
+
+		switch {
+		case *allStages:
+			stages := append([]string(nil), pkg.Stages...)
+			sort.Strings(stages)
+
+			for _, stage := range stages {
+				jobs = append(jobs, stageJob{pkg.Name, stage})
+			}
+		case pkg.ActiveStage == "":
+			jobs = append(jobs, stageJob{pkg.Name, newestStage(pkg.Stages)})
+		default:
+			jobs = append(jobs, stageJob{pkg.Name, pkg.ActiveStage})
+		}
+	}
+
+	if listed != nil {
+		var unknown []string
+		for name, missing := range listed {
+			if missing {
+				unknown = append(unknown, name)
+			}
+		}
+
+		sort.Strings(unknown)
+
+		for _, name := range unknown {
+			if *strictList {
+				fmt.Fprintf(os.Stderr, "-package-list: no package %q on the master\n", name)
+			} else {
+				fmt.Fprintf(os.Stderr, "warning: -package-list: no package %q on the master\n", name)
+			}
+		}
+
+		if *strictList && len(unknown) > 0 {
+			exit(1)
+		}
+	}
+
+	if *startAfter != "" {
+		if !started {
+			fmt.Fprintf(os.Stderr, "-start-after: no package %q to export\n", *startAfter)
+			exit(1)
+		}
+
+		fmt.Fprintf(logOut, "skipped %d packages up to and including %s (-start-after)\n", skipped, *startAfter)
+	}
+
+	if *maxPackages > 0 && len(pkgs) > *maxPackages && !*force {
+		fmt.Fprintf(os.Stderr, "%d packages to export exceed -max-packages %d (override with -force)\n", len(pkgs), *maxPackages)
+		exit(1)
+	}
+
+	if *outSingle == "" && *combinedFile == "" {
+		if collisions := outputCollisions(pkgs, *splitThreshold > 0); len(collisions) > 0 {
+			for _, names := range collisions {
+				quoted := make([]string, 0, len(names))
+				for _, name := range names {
+					quoted = append(quoted, strconv.Quote(name))
+				}
+
+				if *splitThreshold > 0 {
+					fmt.Fprintf(os.Stderr, "packages %s would overwrite each other's bundles or -split-threshold parts\n", strings.Join(quoted, ", "))
+				} else {
+					fmt.Fprintf(os.Stderr, "packages %s would all be written to %s\n", strings.Join(quoted, ", "), bundleFile(names[0]))
 				}
 			}
 
-			uploadFiles := map[string]string{}
-
-			for _, file := range files.Results {
-				if file.Type == "file" && strings.Contains(file.Name, "/") {
-					var content []byte
-
-					{
-						/*
-							steps := strings.Split(file.Name, "/")
-							for i, step := range steps {
-								steps[i] = url.PathEscape(step)
-							}
-						*/
-
-						errSR := sendReq(
-							client, req,
-							"GET", "/v1/config/files/"+url.PathEscape(pkg.Name)+"/"+
-								url.PathEscape(pkg.ActiveStage)+"/"+file.Name, //+strings.Join(steps, "/"),
-							nil, &content,
-						)
-						if errSR != nil {
-							fmt.Fprintln(os.Stderr, errSR.Error())
-							os.Exit(1)
-						}
-					}
+			exit(1)
+		}
 
-					uploadFiles[file.Name] = string(content)
+		for _, f := range formats {
+			if *index && !*excludeContent && !*allStages && f == "json" {
+				for _, pkg := range pkgs {
+					if strings.EqualFold(bundleFile(pkg), "index.json") {
+						fmt.Fprintf(os.Stderr, "package %q would be overwritten by -index\n", pkg)
+						exit(1)
+					}
 				}
 			}
+		}
+	}
+
+	exp := &exporter{
+		api: api, skipEmpty: *skipEmpty, stripPrefix: *stripPrefix, htmlEscape: *htmlEscape,
+		queryStyle: *endpointStyle == "query", withMeta: *withMeta, outDir: outDir, log: logOut,
+		formats: formats, modes: modes, allStages: *allStages,
+		fileConcurrency: *fileConcurrency, preferArchive: *preferArchive, index: *index,
+		checksumAlgo: *checksumAlgo, excludeGlobs: excludeGlobs, verbose: *conn.client.verbose,
+		includeRegexes: includeRegexes, excludeRegexes: excludeRegexes,
+		includeExts: extensionSet(*extInclude), excludeExts: extensionSet(*extExclude), zones: zones,
+		excludeContent: *excludeContent, gitAttributes: *gitAttributes, onDuplicate: *onDuplicate,
+		splitThreshold: *splitThreshold, preview: *preview, maxTotalBytes: *maxTotalBytes,
+		onStageChange: *onStageChange, activeStages: activeStages, keepEmptyDirs: *keepEmptyDirs, encode: *encode,
+	}
+
+	if *embedMeta {
+		exp.source = &bundleMeta{
+			Host: *conn.host, Port: *conn.port, CN: *conn.cn,
+			Exported: exportTime.UTC().Format(time.RFC3339), Version: toolVersion(),
+		}
+	}
+
+	if *hookCommand != "" {
+		hook := &postHook{command: strings.Fields(*hookCommand), strict: *hookStrict, log: logOut}
+
+		if *hookScope == "package" {
+			exp.hook = hook
+		} else {
+			path := outDir
+			if *outSingle != "" {
+				path = *outSingle
+			} else if *combinedFile != "" {
+				path = *combinedFile
+			}
+
+			atExit = append(atExit, func() {
+				if !hook.run("", path, exitStatus) && exitStatus == 0 {
+					exitStatus = 1
+				}
+			})
+		}
+	}
+	if outDir != "" {
+		if errMA := os.MkdirAll(outDir, 0755); errMA != nil {
+			fmt.Fprintln(os.Stderr, errMA.Error())
+			exit(1)
+		}
+
+		if errCO := chownOutput(outDir); errCO != nil {
+			fmt.Fprintln(os.Stderr, errCO.Error())
+			exit(1)
+		}
+	}
+
+	if *resultsFile != "" {
+		exp.results = []fileResult{}
+
+		atExit = append(atExit, func() {
+			exp.resultsMtx.Lock()
+			defer exp.resultsMtx.Unlock()
 
-			if len(uploadFiles) > 0 {
-				f, errOp := os.Create(url.PathEscape(pkg.Name) + ".json")
-				if errOp != nil {
-					fmt.Fprintln(os.Stderr, errOp.Error())
-					os.Exit(1)
+			if !*checksumsReset {
+				merged, errMR := mergeResults(*resultsFile, pkgs, exp.results)
+				if errMR != nil {
+					fmt.Fprintln(os.Stderr, errMR.Error())
+
+					if exitStatus == 0 {
+						exitStatus = 1
+					}
+
+					return
 				}
 
-				buf := bufio.NewWriter(f)
+				exp.results = merged
+			}
+
+			sort.Slice(exp.results, func(i, j int) bool {
+				a, b := &exp.results[i], &exp.results[j]
+				if a.Package != b.Package {
+					return a.Package < b.Package
+				}
 
-				errEc := json.NewEncoder(buf).Encode(&struct {
-					Files map[string]string `json:"files"`
-				}{uploadFiles})
-				if errEc != nil {
-					fmt.Fprintln(os.Stderr, errEc.Error())
-					os.Exit(1)
+				if a.Stage != b.Stage {
+					return a.Stage < b.Stage
 				}
 
-				if errFl := buf.Flush(); errFl != nil {
-					fmt.Fprintln(os.Stderr, errFl.Error())
-					os.Exit(1)
+				return a.Name < b.Name
+			})
+
+			if errWJ := writeJSON(*resultsFile, exp.results, *htmlEscape); errWJ != nil {
+				fmt.Fprintln(os.Stderr, errWJ.Error())
+			}
+		})
+	}
+
+	if *outSingle != "" {
+		exp.single = map[string]*bundle{}
+	}
+
+	if *outputWriters > 0 {
+		exp.writers = make(chan struct{}, *outputWriters)
+	}
+
+	if *casDir != "" {
+		cs, errNS := newCASStore(*casDir, *conn.host, exportTime)
+		if errNS != nil {
+			fmt.Fprintln(os.Stderr, errNS.Error())
+			exit(1)
+		}
+
+		exp.cas = cs
+	}
+
+	if *mergeStages {
+		exp.merged = newStageMerger()
+	}
+
+	if *combinedFile != "" {
+		cw, errNC := newCombinedWriter(*combinedFile, *htmlEscape)
+		if errNC != nil {
+			fmt.Fprintln(os.Stderr, errNC.Error())
+			exit(1)
+		}
+
+		exp.combined = cw
+
+		atExit = append(atExit, func() {
+			if exitStatus != 0 {
+				cw.abort()
+			}
+		})
+	}
+
+	results := make([]exportResult, len(jobs))
+	for i := range results {
+		results[i].done = make(chan struct{})
+	}
+
+	queue := make(chan int)
+
+	for i := 0; i < *concurrency; i++ {
+		go func() {
+			for j := range queue {
+				res := &results[j]
+				log := logOut
+
+				if *ordered {
+					log = &res.log
 				}
 
-				if errCl := f.Close(); errCl != nil {
-					fmt.Fprintln(os.Stderr, errCl.Error())
-					os.Exit(1)
+				res.bundle, res.err = exp.fetch(jobs[j], log)
+				jobs[j], res.bundle, res.err = exp.recheck(jobs[j], log, res.bundle, res.err)
+
+				// Bad credentials won't get better for the other packages, so don't wait for this one's turn.
+				if bhs, ok := res.err.(badHttpStatus); !*ordered || ok && bhs.code == http.StatusUnauthorized {
+					exp.finish(jobs[j], res)
 				}
+
+				close(res.done)
 			}
+		}()
+	}
+
+	go func() {
+		for i := range jobs {
+			queue <- i
+		}
+
+		close(queue)
+	}()
+
+	for i := range results {
+		<-results[i].done
+
+		if *ordered {
+			logOut.Write(results[i].log.Bytes())
+			exp.finish(jobs[i], &results[i])
 		}
 	}
-}
 
-func sendReq(client *http.Client, base *http.Request, method, uri string, in, out interface{}) error {
-	req := *base
-	url := *req.URL
+	if *outSingle != "" {
+		var errWr error
+		if formats[0] == "text" {
+			errWr = writeFile(*outSingle, func(w io.Writer) error {
+				return fillText(w, exp.single)
+			})
+		} else {
+			encoded := make(map[string]*bundle, len(exp.single))
+			for name, bndl := range exp.single {
+				encoded[name] = encodeBundle(bndl, *encode)
+			}
+
+			errWr = writeJSON(*outSingle, encoded, *htmlEscape)
+		}
 
-	req.Method = method
-	req.URL = &url
-	url.Path = uri
+		if errWr != nil {
+			fmt.Fprintln(os.Stderr, errWr.Error())
+			exit(1)
+		}
+	}
 
-	if in != nil {
-		buf := &bytes.Buffer{}
-		if errEc := json.NewEncoder(buf).Encode(in); errEc != nil {
-			return errEc
+	if exp.cas != nil {
+		manifest, errCl := exp.cas.close(exportTime)
+		if errCl != nil {
+			fmt.Fprintln(os.Stderr, errCl.Error())
+			exit(1)
 		}
 
-		req.Body = closableReader{buf}
+		fmt.Fprintf(logOut, "manifest written to %s\n", manifest)
 	}
 
-	resp, errDo := client.Do(&req)
-	if errDo != nil {
-		return errDo
+	if len(zones) > 0 {
+		fmt.Fprintf(logOut, "%d files in -zone %s\n", atomic.LoadInt64(&exp.inZones), strings.Join(zones, ", "))
 	}
 
-	defer resp.Body.Close()
+	if exp.merged != nil {
+		merged, errWr := exp.merged.write(outDir, *htmlEscape)
+		if errWr != nil {
+			fmt.Fprintln(os.Stderr, errWr.Error())
+			exit(1)
+		}
 
-	if resp.StatusCode != 200 {
-		io.Copy(os.Stderr, resp.Body)
-		return badHttpStatus{resp.StatusCode}
+		for _, path := range merged {
+			fmt.Fprintf(logOut, "merged stages written to %s\n", path)
+		}
 	}
 
-	if out != nil {
-		if bs, ok := out.(*[]byte); ok {
-			body, errRA := ioutil.ReadAll(resp.Body)
-			if errRA != nil {
-				return errRA
-			}
+	if exp.combined != nil {
+		if errCl := exp.combined.close(); errCl != nil {
+			fmt.Fprintln(os.Stderr, errCl.Error())
+			exit(1)
+		}
+	}
 
-			*bs = body
-		} else if errDc := json.NewDecoder(bufio.NewReader(resp.Body)).Decode(out); errDc != nil {
-			return errDc
+	if *index {
+		if errWJ := writeJSON(filepath.Join(outDir, "index.json"), buildIndex(jobs, results), *htmlEscape); errWJ != nil {
+			fmt.Fprintln(os.Stderr, errWJ.Error())
+			exit(1)
 		}
 	}
 
-	return nil
+	if *gitAttributes {
+		if errWG := writeGitFiles(outDir, exp.binary); errWG != nil {
+			fmt.Fprintln(os.Stderr, errWG.Error())
+			exit(1)
+		}
+	}
+
+	capped := 0
+	order := make([]int, len(jobs))
+	created := make([]time.Time, len(jobs))
+
+	for i, job := range jobs {
+		order[i] = i
+		created[i], _ = stageTime(job.stage)
+	}
+
+	// Stages of unknown age last
+	if *sortRecent {
+		sort.SliceStable(order, func(i, j int) bool {
+			return created[order[i]].After(created[order[j]])
+		})
+	}
+
+	summary := make([]summaryEntry, 0, len(jobs))
+
+	for _, i := range order {
+		job := jobs[i]
+		res := &results[i]
+		entry := summaryEntry{Package: job.pkg, Stage: job.stage, Files: res.files, Bytes: res.bytes, Paths: res.paths}
+		if !created[i].IsZero() {
+			entry.StageCreated = created[i].UTC().Format(time.RFC3339)
+		}
+
+		if res.capped {
+			entry.Capped = true
+			capped++
+		}
+
+		summary = append(summary, entry)
+	}
+
+	if *output == "json" {
+		render(*output, summary, nil)
+	} else {
+		for _, i := range order {
+			job := jobs[i]
+			res := &results[i]
+			if res.capped {
+				fmt.Fprintf(logOut, "%s: not exported (-max-total-bytes)\n", exp.outputName(job))
+				continue
+			}
+
+			fmt.Fprintf(logOut, "%s: %d files, %d bytes", exp.outputName(job), res.files, res.bytes)
+
+			if res.meta != nil && res.meta.Stage != "" {
+				fmt.Fprintf(logOut, ", stage %s", res.meta.Stage)
+			}
+
+			if !created[i].IsZero() {
+				since := "created"
+				if job.stage == activeStages[job.pkg] {
+					since = "active since"
+				}
+
+				fmt.Fprintf(logOut, ", %s %s", since, created[i].UTC().Format(time.RFC3339))
+			}
+
+			if len(formats) > 1 && len(res.paths) > 0 {
+				fmt.Fprintf(logOut, ", written to %s", strings.Join(res.paths, ", "))
+			}
+
+			fmt.Fprintln(logOut)
+		}
+	}
+
+	if capped > 0 {
+		fmt.Fprintf(
+			os.Stderr, "stopped after downloading %d bytes (-max-total-bytes %d), %d of %d packages not exported\n",
+			atomic.LoadInt64(&exp.downloaded), *maxTotalBytes, capped, len(jobs),
+		)
+		exit(3)
+	}
+
+	{
+		exported := map[string]bool{}
+		files := 0
+
+		for i, job := range jobs {
+			exported[job.pkg] = true
+			files += results[i].files
+		}
+
+		incomplete := false
+
+		if len(exported) < *minPackages {
+			fmt.Fprintf(os.Stderr, "exported %d packages, expected at least %d (-min-packages)\n", len(exported), *minPackages)
+			incomplete = true
+		}
+
+		if files < *minFiles {
+			fmt.Fprintf(os.Stderr, "exported %d files, expected at least %d (-min-files)\n", files, *minFiles)
+			incomplete = true
+		}
+
+		// Not pruning older, probably complete exports then
+		if incomplete {
+			exit(1)
+		}
+	}
+
+	if *gitCommitFlag {
+		dir := outDir
+		if dir == "" {
+			dir = "."
+		}
+
+		message := fmt.Sprintf("i2pkg export of %s at %s", *conn.host, exportTime.UTC().Format(time.RFC3339))
+
+		committed, errGC := gitCommit(dir, message, *gitPush)
+		if committed {
+			fmt.Fprintf(logOut, "committed %s\n", dir)
+		} else if errGC == nil {
+			fmt.Fprintf(logOut, "nothing changed in %s, not committing\n", dir)
+		}
+
+		if errGC != nil {
+			fmt.Fprintln(os.Stderr, errGC.Error())
+			exit(1)
+		}
+	}
+
+	if *keep > 0 {
+		pruned, errPE := pruneExports(pruneTemplate, outDir, *keep)
+		for _, dir := range pruned {
+			fmt.Fprintf(logOut, "pruned %s\n", dir)
+
+			// Fails as long as other namespaces are in there
+			if pruneTemplate != *outTemplate {
+				os.Remove(filepath.Dir(dir))
+			}
+		}
+
+		if errPE != nil {
+			fmt.Fprintln(os.Stderr, errPE.Error())
+			exit(1)
+		}
+	}
+
+	exit(0)
+}
+
+type exporter struct {
+	api         *apiClient
+	skipEmpty   bool
+	stripPrefix string
+	htmlEscape  bool
+	queryStyle  bool
+	withMeta    bool
+	outDir      string
+	log         io.Writer
+	hook        *postHook
+	formats     []string
+	modes       treeModes
+	allStages   bool
+
+	fileConcurrency int
+	preferArchive   bool
+	index           bool
+	checksumAlgo    string
+	excludeGlobs    []string
+	includeRegexes  []*regexp.Regexp
+	zones           []string
+	// files matching -zone so far
+	inZones        int64
+	includeExts    map[string]bool
+	excludeExts    map[string]bool
+	excludeRegexes []*regexp.Regexp
+	verbose        bool
+	excludeContent bool
+	// set once a master answered HEAD with 404, 405 or 501
+	headUnsupported int32
+	gitAttributes   bool
+	preview         int
+	maxTotalBytes   int64
+	// file content bytes downloaded so far (only with maxTotalBytes)
+	downloaded     int64
+	splitThreshold int
+	onDuplicate    string
+	onStageChange  string
+	keepEmptyDirs  bool
+	encode         string
+
+	binaryMtx sync.Mutex
+	// -format dir's files git should treat as binary, relative to outDir
+	binary []string
+	// embedded into every bundle
+	source *bundleMeta
+
+	singleMtx sync.Mutex
+	single    map[string]*bundle
+
+	combined *combinedWriter
+	cas      *casStore
+	merged   *stageMerger
+	// -parallel-output-writers' semaphore, if any
+	writers chan struct{}
+
+	stagesMtx    sync.Mutex
+	activeStages map[string]string
+
+	resultsMtx sync.Mutex
+	results    []fileResult
+}
+
+func (e *exporter) addResult(job stageJob, res fileResult) {
+	if e.results != nil {
+		res.Package = job.pkg
+		if e.allStages {
+			res.Stage = job.stage
+		}
+
+		e.resultsMtx.Lock()
+		e.results = append(e.results, res)
+		e.resultsMtx.Unlock()
+	}
+}
+
+func (e *exporter) fetch(job stageJob, log io.Writer) (*bundle, error) {
+	api := e.api.withLog(log)
+	stageURI := "/v1/config/stages/" + url.PathEscape(job.pkg) + "/" + url.PathEscape(job.stage)
+
+	var files struct {
+		Results []struct {
+			Name string `json:"name"`
+			Type string `json:"type"`
+		} `json:"results"`
+	}
+
+	var names, dirs []string
+	var contents [][]byte
+	var heads []fileHead
+	var errs []error
+	listed := false
+	archived := false
+
+	if e.capped() {
+		return nil, errCapped
+	}
+
+	if e.preferArchive {
+		var archive stageArchive
+		errSR := api.sendReq("GET", stageURI, nil, &archive)
+		if errSR == nil {
+			e.count(len(archive.body))
+		}
+
+		switch {
+		case errSR == nil && archive.isTar():
+			tarNames, tarContents, errUT := untar(archive.body)
+			if errUT != nil {
+				return nil, fmt.Errorf("%s: %s", e.outputName(job), errUT.Error())
+			}
+
+			for i, name := range tarNames {
+				if !e.excluded(job, name) {
+					names = append(names, name)
+					contents = append(contents, tarContents[i])
+				}
+			}
+
+			errs = make([]error, len(names))
+			archived = true
+		case errSR == nil:
+			// Masters not offering archives just list the stage as usual.
+			if errDc := api.newDecoder(bytes.NewReader(archive.body)).Decode(&files); errDc != nil {
+				return nil, errDc
+			}
+
+			listed = true
+		default:
+			if bhs, ok := errSR.(badHttpStatus); !ok || bhs.code != http.StatusNotAcceptable {
+				return nil, errSR
+			}
+		}
+	}
+
+	if !archived {
+		if !listed {
+			if errSR := api.sendReq("GET", stageURI, nil, &files); errSR != nil {
+				return nil, errSR
+			}
+		}
+
+		for _, file := range files.Results {
+			if file.Type != "file" && file.Type != "directory" {
+				fmt.Fprintf(os.Stderr, "warning: %s: skipping %s of unsupported type %q\n", e.outputName(job), file.Name, file.Type)
+				continue
+			}
+
+			if file.Type == "file" && strings.Contains(file.Name, "/") && !e.excluded(job, file.Name) {
+				names = append(names, file.Name)
+			}
+
+			if file.Type == "directory" && e.keepEmptyDirs {
+				dirs = append(dirs, file.Name)
+			}
+		}
+
+		if e.excludeContent {
+			heads, errs = e.headFiles(api, log, job, names)
+		} else {
+			contents, errs = e.fetchFiles(api, log, job, names)
+		}
+	}
+
+	bndl := &bundle{FormatVersion: bundleFormatVersion, Files: map[string]string{}}
+	sources := map[string]string{}
+
+	// In listing order, so the first failure is reported as without concurrency
+	for i, file := range names {
+		if errs[i] != nil {
+			e.addResult(job, fileResult{Name: file, Status: "failed"})
+			return nil, errs[i]
+		}
+
+		name := e.strip(job, file)
+
+		// E.g. -strip-path-prefix turning a/x into x while there's also x
+		if source, ok := sources[name]; ok {
+			switch e.onDuplicate {
+			case "skip":
+				fmt.Fprintf(os.Stderr, "warning: %s: %s and %s are both %s, skipping the latter\n", e.outputName(job), source, file, name)
+				e.addResult(job, fileResult{Name: file, Status: "duplicate"})
+				continue
+			case "overwrite":
+				fmt.Fprintf(os.Stderr, "warning: %s: %s and %s are both %s, keeping the latter\n", e.outputName(job), source, file, name)
+				bndl.remove(name)
+			default:
+				return nil, fmt.Errorf("%s: %s and %s are both %s (see -on-duplicate)", e.outputName(job), source, file, name)
+			}
+		}
+
+		sources[name] = file
+
+		if heads != nil {
+			entry := indexFile{name, int(heads[i].size), heads[i].checksum}
+			bndl.listing = append(bndl.listing, entry)
+			e.addResult(job, fileResult{Name: file, Bytes: entry.Bytes, fileChecksum: entry.fileChecksum, Status: "listed"})
+			continue
+		}
+
+		content := contents[i]
+		contents[i] = nil
+
+		res := fileResult{
+			Name: file, Bytes: len(content),
+			fileChecksum: newChecksum(e.checksumAlgo, content), Status: "exported",
+		}
+
+		if e.preview > 0 && len(content) > e.preview {
+			if bndl.previewed == nil {
+				bndl.FormatVersion = extendedFormatVersion
+				bndl.previewed = map[string]indexFile{}
+			}
+
+			bndl.previewed[name] = indexFile{name, len(content), res.fileChecksum}
+			bndl.Truncated = append(bndl.Truncated, name)
+			content = content[:e.preview]
+		}
+
+		if e.skipEmpty && len(content) == 0 {
+			bndl.Empty = append(bndl.Empty, name)
+			res.Status = "empty"
+		} else {
+			bndl.Files[name] = string(content)
+		}
+
+		e.addResult(job, res)
+	}
+
+	sort.Strings(bndl.Empty)
+	sort.Strings(bndl.Truncated)
+
+	for _, dir := range dirs {
+		name := dir + "/"
+		if e.stripPrefix != "" {
+			// Unlike files, directories above the prefix are just not needed.
+			if !strings.HasPrefix(name, e.stripPrefix) {
+				continue
+			}
+
+			name = name[len(e.stripPrefix):]
+		}
+
+		if name = strings.TrimSuffix(name, "/"); name != "" {
+			bndl.dirs = append(bndl.dirs, name)
+		}
+	}
+
+	if e.activeStages != nil {
+		bndl.Inactive = job.stage != e.activeStage(job.pkg)
+	}
+
+	if e.allStages {
+		bndl.Package = job.pkg
+	}
+
+	if e.source != nil {
+		meta := *e.source
+		bndl.Meta = &meta
+	}
+
+	if e.withMeta {
+		if bndl.Meta == nil {
+			bndl.Meta = &bundleMeta{}
+		}
+
+		bndl.Meta.Stage = job.stage
+		if created, ok := stageTime(job.stage); ok {
+			bndl.Meta.StageCreated = created.UTC().Format(time.RFC3339)
+		}
+	}
+
+	return bndl, nil
+}
+
+// remove deletes name from Files, Empty and listing.
+func (b *bundle) remove(name string) {
+	delete(b.Files, name)
+
+	for i, empty := range b.Empty {
+		if empty == name {
+			b.Empty = append(b.Empty[:i], b.Empty[i+1:]...)
+			break
+		}
+	}
+
+	for i, file := range b.listing {
+		if file.Name == name {
+			b.listing = append(b.listing[:i], b.listing[i+1:]...)
+			break
+		}
+	}
+}
+
+func (e *exporter) finish(job stageJob, res *exportResult) {
+	var paths []string
+	if e.single == nil && e.combined == nil && e.cas == nil && e.merged == nil {
+		base := filepath.Join(e.outDir, url.PathEscape(job.pkg))
+
+		if e.allStages {
+			base = filepath.Join(base, url.PathEscape(job.stage))
+		}
+
+		for _, format := range e.formats {
+			paths = append(paths, base+formatSuffixes[format])
+		}
+	}
+
+	if res.err == errCapped {
+		res.capped = true
+		res.bundle = nil
+		return
+	}
+
+	if res.err != nil {
+		// Unlike 401s, 403s may be due to per-package permission filters.
+		if bhs, ok := res.err.(badHttpStatus); ok && bhs.code == http.StatusForbidden {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", e.outputName(job), res.err.Error())
+		} else {
+			fmt.Fprintln(os.Stderr, res.err.Error())
+		}
+
+		if e.hook != nil {
+			e.hook.run(job.pkg, "", 1)
+		}
+
+		exit(1)
+	}
+
+	if len(res.bundle.Files) > 0 || len(res.bundle.Empty) > 0 {
+		if e.single != nil {
+			e.singleMtx.Lock()
+			e.single[e.outputName(job)] = res.bundle
+			e.singleMtx.Unlock()
+		} else if e.combined != nil {
+			if errAd := e.combined.add(e.outputName(job), combinedEntry{e.activeStage(job.pkg), encodeBundle(res.bundle, e.encode)}); errAd != nil {
+				fmt.Fprintln(os.Stderr, errAd.Error())
+				exit(1)
+			}
+		} else if e.merged != nil {
+			e.merged.add(job.pkg, job.stage, res.bundle)
+		} else if e.cas != nil {
+			if errAd := e.cas.add(job.pkg, job.stage, res.bundle); errAd != nil {
+				fmt.Fprintln(os.Stderr, errAd.Error())
+				exit(1)
+			}
+		} else {
+			if e.writers != nil {
+				e.writers <- struct{}{}
+			}
+
+			for i, format := range e.formats {
+				if errWr := e.write(format, paths[i], job, res.bundle); errWr != nil {
+					fmt.Fprintln(os.Stderr, errWr.Error())
+
+					if e.hook != nil {
+						e.hook.run(job.pkg, paths[i], 1)
+					}
+
+					exit(1)
+				}
+
+				if format == "dir" && e.gitAttributes {
+					e.addBinary(paths[i], res.bundle)
+				}
+			}
+
+			if e.writers != nil {
+				<-e.writers
+			}
+		}
+	} else {
+		paths = nil
+	}
+
+	// The hook gets the first -format's output.
+	hookPath := ""
+	if len(paths) > 0 {
+		hookPath = paths[0]
+	}
+
+	if e.hook != nil && !e.hook.run(job.pkg, hookPath, 0) {
+		exit(1)
+	}
+
+	res.files = len(res.bundle.Files) + len(res.bundle.Empty) + len(res.bundle.listing)
+	for name, content := range res.bundle.Files {
+		if full, ok := res.bundle.previewed[name]; ok {
+			res.bytes += full.Bytes
+		} else {
+			res.bytes += len(content)
+		}
+	}
+
+	for _, file := range res.bundle.listing {
+		res.bytes += file.Bytes
+	}
+
+	if e.index {
+		res.manifest = manifest(res.bundle, e.checksumAlgo)
+	}
+
+	res.meta = res.bundle.Meta
+	res.paths = paths
+	res.bundle = nil
+}
+
+// maxRefetches limits -on-stage-change refetch per package.
+const maxRefetches = 3
+
+// recheck handles (-on-stage-change) active stages replaced while fetching them.
+// fetch itself only ever requests the stage name listed at the beginning.
+func (e *exporter) recheck(job stageJob, log io.Writer, bndl *bundle, errFt error) (stageJob, *bundle, error) {
+	if e.onStageChange == "ignore" || e.allStages {
+		return job, bndl, errFt
+	}
+
+	for refetches := 0; job.stage == e.activeStage(job.pkg); refetches++ {
+		var packages struct {
+			Results []stagedPackage `json:"results"`
+		}
+
+		if errSR := e.api.withLog(log).sendReq("GET", "/v1/config/packages", nil, &packages); errSR != nil {
+			return job, nil, fmt.Errorf("%s: re-checking the active stage: %s", e.outputName(job), errSR.Error())
+		}
+
+		current := ""
+		for _, pkg := range packages.Results {
+			if pkg.Name == job.pkg {
+				current = pkg.ActiveStage
+				break
+			}
+		}
+
+		if current == job.stage {
+			break
+		}
+
+		to := current
+		if to == "" {
+			to = "none"
+		}
+
+		change := fmt.Sprintf("%s: active stage changed from %s to %s during export", e.outputName(job), job.stage, to)
+
+		switch {
+		case e.onStageChange == "fail":
+			return job, nil, errors.New(change)
+		case e.onStageChange == "warn" || current == "":
+			fmt.Fprintf(os.Stderr, "warning: %s\n", change)
+			return job, bndl, errFt
+		case refetches >= maxRefetches:
+			return job, nil, fmt.Errorf("%s, still changing after %d re-fetches", change, refetches)
+		}
+
+		fmt.Fprintf(log, "%s, fetching that one\n", change)
+
+		e.stagesMtx.Lock()
+		e.activeStages[job.pkg] = current
+		e.stagesMtx.Unlock()
+
+		job = stageJob{job.pkg, current}
+		bndl, errFt = e.fetch(job, log)
+	}
+
+	return job, bndl, errFt
+}
+
+func (e *exporter) activeStage(pkg string) string {
+	e.stagesMtx.Lock()
+	defer e.stagesMtx.Unlock()
+
+	return e.activeStages[pkg]
+}
+
+func (e *exporter) addBinary(dir string, bndl *bundle) {
+	rel, errRl := filepath.Rel(e.outDir, dir)
+	if errRl != nil {
+		return
+	}
+
+	for name, content := range bndl.Files {
+		if isBinary(content) {
+			e.binaryMtx.Lock()
+			e.binary = append(e.binary, filepath.ToSlash(rel)+"/"+name)
+			e.binaryMtx.Unlock()
+		}
+	}
+}
+
+func (e *exporter) strip(job stageJob, name string) string {
+	if e.stripPrefix != "" {
+		if strings.HasPrefix(name, e.stripPrefix) {
+			return name[len(e.stripPrefix):]
+		}
+
+		fmt.Fprintf(
+			os.Stderr, "warning: %s: %s doesn't start with %s, recording it as is (import will prefix it anyway)\n",
+			e.outputName(job), name, e.stripPrefix,
+		)
+	}
+
+	return name
+}
+
+// excluded applies -zone, -ext-include/-ext-exclude, -exclude-file-glob and -file-regex(-exclude) in that order
+// to a stage's file (directories and other types are sorted out before).
+func (e *exporter) excluded(job stageJob, name string) bool {
+	if len(e.zones) > 0 {
+		inZone := false
+		for _, zone := range e.zones {
+			if strings.HasPrefix(name, "zones.d/"+zone+"/") {
+				inZone = true
+				break
+			}
+		}
+
+		if !inZone {
+			if e.verbose {
+				fmt.Fprintf(os.Stderr, "%s: skipping %s (not in -zone)\n", e.outputName(job), name)
+			}
+
+			return true
+		}
+
+		atomic.AddInt64(&e.inZones, 1)
+	}
+
+	ext := strings.ToLower(strings.TrimPrefix(path.Ext(name), "."))
+	if len(e.includeExts) > 0 && !e.includeExts[ext] || e.excludeExts[ext] {
+		if e.verbose {
+			fmt.Fprintf(os.Stderr, "%s: skipping %s (-ext-include/-ext-exclude)\n", e.outputName(job), name)
+		}
+
+		return true
+	}
+
+	for _, glob := range e.excludeGlobs {
+		if matchGlob(glob, name) {
+			if e.verbose {
+				fmt.Fprintf(os.Stderr, "%s: skipping %s (-exclude-file-glob %s)\n", e.outputName(job), name, glob)
+			}
+
+			return true
+		}
+	}
+
+	if len(e.includeRegexes) > 0 {
+		included := false
+		for _, re := range e.includeRegexes {
+			if re.MatchString(name) {
+				included = true
+				break
+			}
+		}
+
+		if !included {
+			if e.verbose {
+				fmt.Fprintf(os.Stderr, "%s: skipping %s (no -file-regex matches)\n", e.outputName(job), name)
+			}
+
+			return true
+		}
+	}
+
+	for _, re := range e.excludeRegexes {
+		if re.MatchString(name) {
+			if e.verbose {
+				fmt.Fprintf(os.Stderr, "%s: skipping %s (-file-regex-exclude %s)\n", e.outputName(job), name, re)
+			}
+
+			return true
+		}
+	}
+
+	return false
+}
+
+// extensionSet parses -ext-include or -ext-exclude, leading dots are optional.
+func extensionSet(list string) map[string]bool {
+	set := map[string]bool{}
+	for _, ext := range strings.Split(list, ",") {
+		if ext = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(ext), ".")); ext != "" {
+			set[ext] = true
+		}
+	}
+
+	return set
+}
+
+// compileRegexes compiles the patterns of the flag name or exits.
+func compileRegexes(name string, patterns []string) []*regexp.Regexp {
+	regexes := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		re, errCp := regexp.Compile(pattern)
+		if errCp != nil {
+			fmt.Fprintf(os.Stderr, "%s: bad pattern %q: %s\n", name, pattern, errCp.Error())
+			exit(2)
+		}
+
+		regexes = append(regexes, re)
+	}
+
+	return regexes
+}
+
+func (e *exporter) count(bytes int) {
+	if e.maxTotalBytes > 0 {
+		atomic.AddInt64(&e.downloaded, int64(bytes))
+	}
+}
+
+func (e *exporter) capped() bool {
+	return e.maxTotalBytes > 0 && atomic.LoadInt64(&e.downloaded) >= e.maxTotalBytes
+}
+
+// fetchFiles GETs the named files of job's stage with up to fileConcurrency requests at once.
+func (e *exporter) fetchFiles(api *apiClient, log io.Writer, job stageJob, names []string) ([][]byte, []error) {
+	contents := make([][]byte, len(names))
+
+	errs := e.eachFile(api, log, names, func(api *apiClient, i int) error {
+		errSR := api.sendReq("GET", fileURI(job.pkg, job.stage, names[i], e.queryStyle), nil, &contents[i])
+		if errSR == nil {
+			e.count(len(contents[i]))
+		}
+
+		return errSR
+	})
+
+	return contents, errs
+}
+
+// headFiles is like fetchFiles, but only HEADs the files for their sizes and, if the master sends Digest headers, checksums.
+// Masters not answering HEAD (or not with a Content-Length) get GETs, but their content is only counted and hashed.
+func (e *exporter) headFiles(api *apiClient, log io.Writer, job stageJob, names []string) ([]fileHead, []error) {
+	heads := make([]fileHead, len(names))
+
+	errs := e.eachFile(api, log, names, func(api *apiClient, i int) error {
+		uri := fileURI(job.pkg, job.stage, names[i], e.queryStyle)
+
+		if atomic.LoadInt32(&e.headUnsupported) == 0 {
+			errSR := api.sendReq("HEAD", uri, nil, &heads[i])
+			if errSR == nil {
+				if heads[i].size >= 0 {
+					return nil
+				}
+			} else if bhs, ok := errSR.(badHttpStatus); ok && (bhs.code == http.StatusNotFound ||
+				bhs.code == http.StatusMethodNotAllowed || bhs.code == http.StatusNotImplemented) {
+				atomic.StoreInt32(&e.headUnsupported, 1)
+			} else {
+				return errSR
+			}
+		}
+
+		var content []byte
+		if errSR := api.sendReq("GET", uri, nil, &content); errSR != nil {
+			return errSR
+		}
+
+		e.count(len(content))
+		heads[i] = fileHead{int64(len(content)), newChecksum(e.checksumAlgo, content)}
+		return nil
+	})
+
+	return heads, errs
+}
+
+// eachFile calls do for every index of names with up to fileConcurrency calls at once until one fails.
+func (e *exporter) eachFile(api *apiClient, log io.Writer, names []string, do func(api *apiClient, i int) error) []error {
+	errs := make([]error, len(names))
+
+	if e.fileConcurrency > 1 {
+		api = api.withLog(&syncWriter{w: log})
+	}
+
+	// Zero (e.g. an exporter literal not setting it) would start no workers at all.
+	workers := e.fileConcurrency
+	if workers < 1 {
+		workers = 1
+	}
+
+	queue := make(chan int)
+	var failed int32
+	var wg sync.WaitGroup
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for j := range queue {
+				if atomic.LoadInt32(&failed) == 0 {
+					if e.capped() {
+						errs[j] = errCapped
+					} else {
+						errs[j] = do(api, j)
+					}
+
+					if errs[j] != nil {
+						atomic.StoreInt32(&failed, 1)
+					}
+				}
+			}
+		}()
+	}
+
+	for i := range names {
+		queue <- i
+	}
+
+	close(queue)
+	wg.Wait()
+
+	return errs
+}
+
+// formatSuffixes map -format values to what they append to the output path.
+var formatSuffixes = map[string]string{"json": ".json", "dir": "", "targz": ".tar.gz", "text": ".txt"}
+
+func (e *exporter) write(format, path string, job stageJob, bndl *bundle) error {
+	if e.allStages {
+		var mode os.FileMode = 0755
+		if format == "dir" {
+			mode = e.modes.dir
+		}
+
+		if errMA := os.MkdirAll(filepath.Dir(path), mode); errMA != nil {
+			return errMA
+		}
+
+		if errCO := chownOutput(filepath.Dir(path)); errCO != nil {
+			return errCO
+		}
+	}
+
+	switch format {
+	case "dir":
+		return writeTree(path, bndl, e.modes)
+	case "targz":
+		return writeTarGz(path, bndl, e.modes)
+	case "text":
+		return writeText(path, e.outputName(job), bndl)
+	default:
+		bndl = encodeBundle(bndl, e.encode)
+
+		if e.splitThreshold > 0 {
+			return writeSplitJSON(path, bndl, e.splitThreshold, e.htmlEscape)
+		}
+
+		return writeJSON(path, bndl, e.htmlEscape)
+	}
+}
+
+// retryConnect calls try until it succeeds, fails with an HTTP status or window elapses, backing off exponentially.
+func retryConnect(window time.Duration, try func() error) error {
+	deadline := time.Now().Add(window)
+	backoff := time.Second
+
+	for attempt := 1; ; attempt++ {
+		errTr := try()
+		if _, ok := errTr.(badHttpStatus); errTr == nil || ok {
+			return errTr
+		}
+
+		left := time.Until(deadline)
+		if left <= 0 {
+			return errTr
+		}
+
+		if backoff > left {
+			backoff = left
+		}
+
+		fmt.Fprintf(os.Stderr, "connection attempt %d failed: %s, retrying in %s\n", attempt, errTr.Error(), backoff)
+		time.Sleep(backoff)
+
+		if backoff *= 2; backoff > 30*time.Second {
+			backoff = 30 * time.Second
+		}
+	}
+}
+
+func toolVersion() string {
+	if info, ok := debug.ReadBuildInfo(); ok {
+		return info.Main.Version
+	}
+
+	return "unknown"
+}
+
+// outputName tells the job's stage apart from its package's other ones if necessary.
+func (e *exporter) outputName(job stageJob) string {
+	if e.allStages {
+		return job.pkg + "/" + job.stage
+	}
+
+	return job.pkg
+}
+
+func fileURI(pkg, stage, file string, queryStyle bool) string {
+	uri := "/v1/config/files/" + url.PathEscape(pkg) + "/" + url.PathEscape(stage)
+	if queryStyle {
+		return uri + "?path=" + url.QueryEscape(file)
+	}
+
+	steps := strings.Split(file, "/")
+	for i, step := range steps {
+		steps[i] = url.PathEscape(step)
+	}
+
+	return uri + "/" + strings.Join(steps, "/")
+}
+
+func bundleFile(pkg string) string {
+	return url.PathEscape(pkg) + ".json"
+}
+
+// outputCollisions returns the groups of packages whose bundle files would overwrite each other,
+// incl. on case-insensitive file systems. With split, also X.partN's with (the parts of) X's.
+func outputCollisions(pkgs []string, split bool) [][]string {
+	written := map[string]bool{}
+	for _, pkg := range pkgs {
+		written[strings.ToLower(bundleFile(pkg))] = true
+	}
+
+	byFile := map[string][]string{}
+	var files []string
+
+	for _, pkg := range pkgs {
+		file := strings.ToLower(bundleFile(pkg))
+
+		if split {
+			// X.partN.json may be X.json's part which also get deleted if stale.
+			for {
+				match := partFile.FindStringSubmatch(file)
+				if match == nil || !written[match[1]+".json"] {
+					break
+				}
+
+				file = match[1] + ".json"
+			}
+		}
+
+		if _, ok := byFile[file]; !ok {
+			files = append(files, file)
+		}
+
+		byFile[file] = append(byFile[file], pkg)
+	}
+
+	var collisions [][]string
+	for _, file := range files {
+		if len(byFile[file]) > 1 {
+			collisions = append(collisions, byFile[file])
+		}
+	}
+
+	return collisions
+}
+
+// mergeResults adds the entries of packages not exported this time from the existing -results file.
+func mergeResults(file string, exported []string, results []fileResult) ([]fileResult, error) {
+	if file == "-" {
+		return results, nil
+	}
+
+	if info, errSt := os.Stat(file); errSt != nil {
+		if os.IsNotExist(errSt) {
+			return results, nil
+		}
+
+		return nil, errSt
+	} else if !info.Mode().IsRegular() {
+		return results, nil
+	}
+
+	content, errRF := ioutil.ReadFile(file)
+	if errRF != nil {
+		return nil, errRF
+	}
+
+	var previous []fileResult
+	if errUJ := json.Unmarshal(content, &previous); errUJ != nil {
+		return nil, fmt.Errorf("%s: %s (overwrite it with -checksums-reset)", file, errUJ.Error())
+	}
+
+	touched := map[string]bool{}
+	for _, pkg := range exported {
+		touched[pkg] = true
+	}
+
+	for _, res := range previous {
+		if !touched[res.Package] {
+			results = append(results, res)
+		}
+	}
+
+	return results, nil
+}
+
+func newEncoder(w io.Writer, escapeHTML bool) *json.Encoder {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(escapeHTML)
+	return enc
+}
+
+// writeJSON replaces path atomically unless it's - (stdout) or a non-regular file like a FIFO.
+func writeJSON(path string, v interface{}, escapeHTML bool) error {
+	return writeFile(path, func(w io.Writer) error {
+		return encodeJSON(w, v, escapeHTML)
+	})
+}
+
+// writeFile replaces path atomically with what fill writes unless it's - (stdout) or a non-regular file like a FIFO.
+func writeFile(path string, fill func(w io.Writer) error) error {
+	if path == "-" {
+		return fill(os.Stdout)
+	}
+
+	if info, errSt := os.Stat(path); errSt == nil && !info.Mode().IsRegular() {
+		f, errOp := os.OpenFile(path, os.O_WRONLY, 0)
+		if errOp != nil {
+			return errOp
+		}
+
+		if errFl := fill(f); errFl != nil {
+			f.Close()
+			return errFl
+		}
+
+		return f.Close()
+	}
+
+	tmp := fmt.Sprintf("%s.%d.tmp", path, os.Getpid())
+
+	f, errOp := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if errOp != nil {
+		return errOp
+	}
+
+	if errFl := fill(f); errFl != nil {
+		f.Close()
+		os.Remove(tmp)
+		return errFl
+	}
+
+	if errCl := f.Close(); errCl != nil {
+		os.Remove(tmp)
+		return errCl
+	}
+
+	if errCO := chownOutput(tmp); errCO != nil {
+		os.Remove(tmp)
+		return errCO
+	}
+
+	return os.Rename(tmp, path)
+}
+
+func encodeJSON(w io.Writer, v interface{}, escapeHTML bool) error {
+	buf := bufio.NewWriter(w)
+	if errEc := newEncoder(buf, escapeHTML).Encode(v); errEc != nil {
+		return errEc
+	}
+
+	return buf.Flush()
 }
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// mockMaster serves a single stage's listing and files like /v1/config/stages and /v1/config/files do.
+type mockMaster struct {
+	job stageJob
+	// in listing order
+	names    []string
+	contents map[string]string
+}
+
+func newMockMaster(job stageJob, files int) *mockMaster {
+	mm := &mockMaster{job: job, contents: map[string]string{}}
+
+	for i := 0; i < files; i++ {
+		name := fmt.Sprintf("conf.d/%04d.conf", i)
+		mm.names = append(mm.names, name)
+		mm.contents[name] = fmt.Sprintf("object Host \"host-%d\" { check_command = \"dummy\" }\n", i)
+	}
+
+	return mm
+}
+
+func (mm *mockMaster) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	stage := mm.job.pkg + "/" + mm.job.stage
+
+	switch {
+	case r.URL.Path == "/v1/config/stages/"+stage:
+		type entry struct {
+			Name string `json:"name"`
+			Type string `json:"type"`
+		}
+
+		listing := struct {
+			Results []entry `json:"results"`
+		}{[]entry{{"conf.d", "directory"}}}
+
+		for _, name := range mm.names {
+			listing.Results = append(listing.Results, entry{name, "file"})
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(&listing)
+	case strings.HasPrefix(r.URL.Path, "/v1/config/files/"+stage+"/"):
+		content, ok := mm.contents[strings.TrimPrefix(r.URL.Path, "/v1/config/files/"+stage+"/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		io.WriteString(w, content)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// newTestAPI serves handler via TLS and returns a client for it logging to log.
+func newTestAPI(t testing.TB, handler http.Handler, log io.Writer) *apiClient {
+	srv := httptest.NewTLSServer(handler)
+	t.Cleanup(srv.Close)
+
+	host, port, errSH := net.SplitHostPort(srv.Listener.Addr().String())
+	if errSH != nil {
+		t.Fatal(errSH)
+	}
+
+	ca := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}))
+
+	api, errNC := newAPIClient(host, port, ca, "example.com", "root", "secret", clientOptions{maxRedirects: 10})
+	if errNC != nil {
+		t.Fatal(errNC)
+	}
+
+	return api.withLog(log)
+}
+
+func TestOutputCollisions(t *testing.T) {
+	cases := []struct {
+		name       string
+		pkgs       []string
+		split      bool
+		collisions [][]string
+	}{
+		{"distinct", []string{"a", "b", "a-b", "a_b"}, false, nil},
+		// url.PathEscape escapes % as well, so these stay apart.
+		{"escaped vs. unescaped", []string{"a/b", "a%2Fb", "x y", "x%20y"}, false, nil},
+		{"case only", []string{"Prod", "prod", "PROD", "test"}, false, [][]string{{"Prod", "prod", "PROD"}}},
+		// a%2Fb.json and A%2FB.json are one file on case-insensitive file systems.
+		{"after escaping", []string{"a/b", "A/B", "a%2Fb"}, false, [][]string{{"a/b", "A/B"}}},
+		{"several groups", []string{"x/y", "q", "X/Y", "Q", "z"}, false, [][]string{{"x/y", "X/Y"}, {"q", "Q"}}},
+		{"parts unsplit", []string{"a", "a.part1", "a.part2"}, false, nil},
+		// a.part1.json may be a.json's first part.
+		{"parts", []string{"a.part1", "a", "b", "a.part12", "A.PART3", "c.part1"}, true, [][]string{{"a.part1", "a", "a.part12", "A.PART3"}}},
+		{"parts of parts", []string{"a.part1.part2", "b", "a.part1", "a"}, true, [][]string{{"a.part1.part2", "a.part1", "a"}}},
+		{"parts of escaped", []string{"x/y", "x/y.part1"}, true, [][]string{{"x/y", "x/y.part1"}}},
+		{"no parts", []string{"a", "a.part0", "a.part01", "a.partx", "a.part"}, true, nil},
+	}
+
+	for _, c := range cases {
+		if collisions := outputCollisions(c.pkgs, c.split); !reflect.DeepEqual(collisions, c.collisions) {
+			t.Errorf("%s: outputCollisions(%q, %v) = %q, want %q", c.name, c.pkgs, c.split, collisions, c.collisions)
+		}
+	}
+}
+
+func TestFetchConcurrently(t *testing.T) {
+	job := stageJob{"big", "stage-1"}
+	mm := newMockMaster(job, 1000)
+
+	for _, concurrency := range []int{0, 1, 16, 100} {
+		exp := &exporter{
+			api: newTestAPI(t, mm, ioutil.Discard), fileConcurrency: concurrency, checksumAlgo: "sha256",
+			results: []fileResult{},
+		}
+
+		bndl, errFt := exp.fetch(job, ioutil.Discard)
+		if errFt != nil {
+			t.Fatalf("concurrency %d: %s", concurrency, errFt.Error())
+		}
+
+		if !reflect.DeepEqual(bndl.Files, mm.contents) {
+			t.Errorf("concurrency %d: the fetched files differ from the served ones", concurrency)
+		}
+
+		if len(exp.results) != len(mm.names) {
+			t.Fatalf("concurrency %d: %d results, want %d", concurrency, len(exp.results), len(mm.names))
+		}
+
+		for i, res := range exp.results {
+			if res.Name != mm.names[i] || res.Bytes != len(mm.contents[res.Name]) || res.Status != "exported" {
+				t.Errorf("concurrency %d: result #%d is %+v, want %s in listing order", concurrency, i, res, mm.names[i])
+				break
+			}
+		}
+	}
+}
+
+func TestParallelOutputWriters(t *testing.T) {
+	dir, errTD := ioutil.TempDir("", "i2pkg-test-")
+	if errTD != nil {
+		t.Fatal(errTD)
+	}
+
+	defer os.RemoveAll(dir)
+
+	const packages = 300
+	exp := &exporter{
+		outDir: dir, formats: []string{"json"}, encode: "raw", checksumAlgo: "sha256", writers: make(chan struct{}, 8),
+	}
+
+	jobs := make([]stageJob, packages)
+	bundles := make([]*bundle, packages)
+
+	for i := range jobs {
+		jobs[i] = stageJob{fmt.Sprintf("pkg-%03d", i), "stage-1"}
+		bundles[i] = &bundle{FormatVersion: bundleFormatVersion, Files: map[string]string{}}
+
+		for j := 0; j < 5; j++ {
+			bundles[i].Files[fmt.Sprintf("conf.d/%d.conf", j)] = strings.Repeat(fmt.Sprintf("%s %d\n", jobs[i].pkg, j), 1000)
+		}
+	}
+
+	queue := make(chan int)
+	var wg sync.WaitGroup
+
+	for i := 0; i < 64; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for j := range queue {
+				res := &exportResult{bundle: bundles[j]}
+				exp.finish(jobs[j], res)
+
+				if len(res.paths) != 1 {
+					t.Errorf("%s: written to %q", jobs[j].pkg, res.paths)
+				}
+			}
+		}()
+	}
+
+	for i := range jobs {
+		queue <- i
+	}
+
+	close(queue)
+	wg.Wait()
+
+	for i, job := range jobs {
+		bndl, errRB := readBundle(filepath.Join(dir, job.pkg+".json"), 1)
+		if errRB != nil {
+			t.Errorf("%s: %s", job.pkg, errRB.Error())
+			continue
+		}
+
+		if !reflect.DeepEqual(bndl.Files, bundles[i].Files) {
+			t.Errorf("%s: the written files differ from the exported ones", job.pkg)
+		}
+	}
+
+	entries, errRD := ioutil.ReadDir(dir)
+	if errRD != nil {
+		t.Fatal(errRD)
+	}
+
+	if len(entries) != packages {
+		var names []string
+		for _, entry := range entries {
+			if !strings.HasSuffix(entry.Name(), ".json") {
+				names = append(names, entry.Name())
+			}
+		}
+
+		t.Errorf("%d files written, want %d, left over: %q", len(entries), packages, names)
+	}
+}
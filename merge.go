@@ -0,0 +1,135 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// mergedSuffix is appended to -merge-stages' PACKAGE files which are for reading only.
+const mergedSuffix = ".merged.json"
+
+// mergedPackage is the union of all stages' files of a package.
+type mergedPackage struct {
+	Note   string                 `json:"note"`
+	Stages []string               `json:"stages"`
+	Files  map[string]*mergedFile `json:"files"`
+}
+
+type mergedFile struct {
+	// the stages containing the file at all
+	Stages []string `json:"stages"`
+	// set if the stages contain different versions of the file
+	Conflict bool            `json:"conflict,omitempty"`
+	Versions []mergedVersion `json:"versions"`
+}
+
+type mergedVersion struct {
+	SHA256  string   `json:"sha256"`
+	Stages  []string `json:"stages"`
+	Content string   `json:"content"`
+	Symlink string   `json:"symlink,omitempty"`
+}
+
+type stageMerger struct {
+	mtx      sync.Mutex
+	packages map[string]*mergedPackage
+}
+
+func newStageMerger() *stageMerger {
+	return &stageMerger{packages: map[string]*mergedPackage{}}
+}
+
+func (sm *stageMerger) add(pkg, stage string, bndl *bundle) {
+	sm.mtx.Lock()
+	defer sm.mtx.Unlock()
+
+	mp, ok := sm.packages[pkg]
+	if !ok {
+		mp = &mergedPackage{
+			Note:  "i2pkg -merge-stages, for reading only - can't be imported",
+			Files: map[string]*mergedFile{},
+		}
+
+		sm.packages[pkg] = mp
+	}
+
+	mp.Stages = append(mp.Stages, stage)
+
+	for name, content := range bndl.Files {
+		mp.addVersion(name, stage, mergedVersion{Content: content})
+	}
+
+	for _, name := range bndl.Empty {
+		mp.addVersion(name, stage, mergedVersion{})
+	}
+
+	for name, target := range bndl.Symlinks {
+		mp.addVersion(name, stage, mergedVersion{Symlink: target})
+	}
+}
+
+func (mp *mergedPackage) addVersion(name, stage string, version mergedVersion) {
+	raw := sha256.Sum256([]byte(version.Content))
+	version.SHA256 = hex.EncodeToString(raw[:])
+
+	file, ok := mp.Files[name]
+	if !ok {
+		file = &mergedFile{}
+		mp.Files[name] = file
+	}
+
+	file.Stages = append(file.Stages, stage)
+
+	for i := range file.Versions {
+		if v := &file.Versions[i]; v.SHA256 == version.SHA256 && v.Symlink == version.Symlink {
+			v.Stages = append(v.Stages, stage)
+			return
+		}
+	}
+
+	version.Stages = []string{stage}
+	file.Versions = append(file.Versions, version)
+	file.Conflict = len(file.Versions) > 1
+}
+
+// write writes a PACKAGE.merged.json per package into dir and returns their paths.
+func (sm *stageMerger) write(dir string, escapeHTML bool) ([]string, error) {
+	var names []string
+	for name := range sm.packages {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	paths := make([]string, 0, len(names))
+	for _, name := range names {
+		mp := sm.packages[name]
+
+		// Stages were fetched in parallel.
+		sort.Strings(mp.Stages)
+		for _, file := range mp.Files {
+			sort.Strings(file.Stages)
+
+			for i := range file.Versions {
+				sort.Strings(file.Versions[i].Stages)
+			}
+
+			sort.Slice(file.Versions, func(i, j int) bool {
+				return file.Versions[i].Stages[0] < file.Versions[j].Stages[0]
+			})
+		}
+
+		path := filepath.Join(dir, url.PathEscape(name)+mergedSuffix)
+		if errWJ := writeJSON(path, mp, escapeHTML); errWJ != nil {
+			return nil, errWJ
+		}
+
+		paths = append(paths, path)
+	}
+
+	return paths, nil
+}
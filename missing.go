@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+)
+
+// expectedFiles reads the package/file names of an index.json (-index, -exclude-content) or a -results file.
+// Unlike the index, -results records the names as on the master, so it removes stripPrefix from them.
+func expectedFiles(file, stripPrefix string) (map[string]bool, error) {
+	f, errOp := os.Open(file)
+	if errOp != nil {
+		return nil, errOp
+	}
+
+	defer f.Close()
+
+	var entries []struct {
+		Package string `json:"package"`
+		// -results
+		Name   string `json:"name"`
+		Status string `json:"status"`
+		// index.json
+		Files []struct {
+			Name string `json:"name"`
+		} `json:"files"`
+	}
+
+	if errDc := json.NewDecoder(bufio.NewReader(f)).Decode(&entries); errDc != nil {
+		return nil, fmt.Errorf("%s: %s", file, errDc.Error())
+	}
+
+	expected := map[string]bool{}
+
+	for _, entry := range entries {
+		if entry.Name != "" && entry.Status != "failed" {
+			expected[entry.Package+"/"+strings.TrimPrefix(entry.Name, stripPrefix)] = true
+		}
+
+		for _, file := range entry.Files {
+			expected[entry.Package+"/"+file.Name] = true
+		}
+	}
+
+	return expected, nil
+}
+
+// reportMissing compares the files of the packages' active stages with the expected ones of file and exits.
+// Like the index of an export with -strip-path-prefix, it removes stripPrefix from the actual ones.
+func reportMissing(api *apiClient, packages []stagedPackage, file, stripPrefix, output string) {
+	expected, errEF := expectedFiles(file, stripPrefix)
+	if errEF != nil {
+		fmt.Fprintln(os.Stderr, errEF.Error())
+		exit(1)
+	}
+
+	actual := map[string]bool{}
+
+	for _, pkg := range packages {
+		if pkg.Name == "" || pkg.ActiveStage == "" {
+			continue
+		}
+
+		var files struct {
+			Results []struct {
+				Name string `json:"name"`
+				Type string `json:"type"`
+			} `json:"results"`
+		}
+
+		uri := "/v1/config/stages/" + url.PathEscape(pkg.Name) + "/" + url.PathEscape(pkg.ActiveStage)
+		if errSR := api.sendReq("GET", uri, nil, &files); errSR != nil {
+			fmt.Fprintln(os.Stderr, errSR.Error())
+			exit(1)
+		}
+
+		for _, file := range files.Results {
+			if file.Type == "file" && strings.Contains(file.Name, "/") {
+				actual[pkg.Name+"/"+strings.TrimPrefix(file.Name, stripPrefix)] = true
+			}
+		}
+	}
+
+	var lines []string
+	report := struct {
+		Removed []string `json:"removed"`
+		Added   []string `json:"added"`
+	}{[]string{}, []string{}}
+
+	for name := range expected {
+		if !actual[name] {
+			lines = append(lines, "-"+name)
+			report.Removed = append(report.Removed, name)
+		}
+	}
+
+	for name := range actual {
+		if !expected[name] {
+			lines = append(lines, "+"+name)
+			report.Added = append(report.Added, name)
+		}
+	}
+
+	// By name, then removal before addition
+	sort.Slice(lines, func(i, j int) bool {
+		if lines[i][1:] != lines[j][1:] {
+			return lines[i][1:] < lines[j][1:]
+		}
+
+		return lines[i] < lines[j]
+	})
+
+	sort.Strings(report.Removed)
+	sort.Strings(report.Added)
+
+	render(output, report, func(w io.Writer) {
+		for _, line := range lines {
+			fmt.Fprintln(w, line)
+		}
+	})
+
+	if len(report.Removed) > 0 {
+		exit(1)
+	}
+
+	exit(0)
+}
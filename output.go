@@ -0,0 +1,32 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+func addOutputFlag(fs *flag.FlagSet) *string {
+	return fs.String("o", "text", "print the results as `FORMAT` text (for humans) or json (for scripts)")
+}
+
+func validateOutput(format string) {
+	if format != "text" && format != "json" {
+		fmt.Fprintln(os.Stderr, "-o must be text or json")
+		exit(2)
+	}
+}
+
+// render prints v as JSON (-o json) or lets text print it for humans.
+func render(format string, v interface{}, text func(w io.Writer)) {
+	if format != "json" {
+		text(os.Stdout)
+		return
+	}
+
+	if errEJ := encodeJSON(os.Stdout, v, false); errEJ != nil {
+		fmt.Fprintln(os.Stderr, errEJ.Error())
+		exit(1)
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// outputOwner is who -output-uid/-output-gid make own the written files, -1 keeps the respective ID.
+var outputOwner = struct{ uid, gid int }{-1, -1}
+
+// setOutputOwner sets outputOwner if the process is privileged enough or just warns.
+func setOutputOwner(uid, gid int) {
+	if uid < 0 && gid < 0 {
+		return
+	}
+
+	if os.Geteuid() != 0 {
+		fmt.Fprintln(os.Stderr, "warning: not running as root, ignoring -output-uid and -output-gid")
+		return
+	}
+
+	outputOwner.uid = uid
+	outputOwner.gid = gid
+}
+
+// chownOutput gives path (not following symlinks) to outputOwner, if any.
+func chownOutput(path string) error {
+	if outputOwner.uid < 0 && outputOwner.gid < 0 {
+		return nil
+	}
+
+	return os.Lchown(path, outputOwner.uid, outputOwner.gid)
+}
+
+// chownTree applies chownOutput to root and everything inside.
+func chownTree(root string) error {
+	if outputOwner.uid < 0 && outputOwner.gid < 0 {
+		return nil
+	}
+
+	return filepath.Walk(root, func(path string, _ os.FileInfo, errWk error) error {
+		if errWk != nil {
+			return errWk
+		}
+
+		return chownOutput(path)
+	})
+}
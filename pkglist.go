@@ -0,0 +1,29 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"strings"
+)
+
+// readPackageList reads package names, one per line.
+// Surrounding whitespace, blank lines and lines starting with # are ignored.
+func readPackageList(path string) ([]string, error) {
+	f, errOp := os.Open(path)
+	if errOp != nil {
+		return nil, errOp
+	}
+
+	defer f.Close()
+
+	var names []string
+	scanner := bufio.NewScanner(f)
+
+	for scanner.Scan() {
+		if name := strings.TrimSpace(scanner.Text()); name != "" && !strings.HasPrefix(name, "#") {
+			names = append(names, name)
+		}
+	}
+
+	return names, scanner.Err()
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+type connProfile struct {
+	Host        string `json:"host"`
+	Port        string `json:"port"`
+	CA          string `json:"ca"`
+	CN          string `json:"cn"`
+	User        string `json:"user"`
+	PasswordEnv string `json:"password-env"`
+}
+
+func readProfiles(file string) (map[string]connProfile, error) {
+	f, errOp := os.Open(file)
+	if errOp != nil {
+		return nil, errOp
+	}
+
+	defer f.Close()
+
+	var profiles map[string]connProfile
+	if errDc := json.NewDecoder(bufio.NewReader(f)).Decode(&profiles); errDc != nil {
+		return nil, errDc
+	}
+
+	return profiles, nil
+}
+
+func (cp connProfile) connect(opts clientOptions) (*apiClient, error) {
+	if cp.Port == "" {
+		cp.Port = "5665"
+	}
+
+	if cp.PasswordEnv == "" {
+		cp.PasswordEnv = "I2_PASS"
+	}
+
+	if cp.CN == "" {
+		cp.CN = hostName(cp.Host)
+	}
+
+	if cp.CA == "" {
+		cp.CA = os.Getenv("I2_CA")
+	}
+
+	for _, field := range []struct {
+		name  string
+		value string
+	}{{"host", cp.Host}, {"ca", cp.CA}, {"user", cp.User}} {
+		if field.value == "" && (field.name != "user" || opts.tokenFile == "") {
+			return nil, fmt.Errorf("%s missing", field.name)
+		}
+	}
+
+	pass := os.Getenv(cp.PasswordEnv)
+	if pass == "" && opts.tokenFile == "" {
+		return nil, fmt.Errorf("$%s missing", cp.PasswordEnv)
+	}
+
+	return newAPIClient(cp.Host, cp.Port, cp.CA, cp.CN, cp.User, pass, opts)
+}
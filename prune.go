@@ -0,0 +1,149 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type stagedPackage struct {
+	configPackage
+	Stages []string `json:"stages"`
+}
+
+func prune(args []string) {
+	fs := flag.NewFlagSet("prune", flag.ExitOnError)
+	conn := addConnFlags(fs)
+	var packageNames stringList
+	fs.Var(&packageNames, "package", "`NAME` of a package to prune (repeatable)")
+	keep := fs.Int("keep", -1, "`NUMBER` of the newest inactive stages to keep")
+	retention := fs.Duration("retention", 0, "keep inactive stages younger than `DURATION`")
+	yes := fs.Bool("yes", false, "actually delete stages")
+	dryRun := fs.Bool("dry-run", false, "only show which stages would be deleted")
+
+	fs.Parse(args)
+	conn.validate()
+
+	if len(packageNames) < 1 {
+		fmt.Fprintln(os.Stderr, "-package missing")
+		exit(2)
+	}
+
+	if *keep < 0 && *retention <= 0 {
+		fmt.Fprintln(os.Stderr, "-keep or -retention missing")
+		exit(2)
+	}
+
+	if !*yes && !*dryRun {
+		fmt.Fprintln(os.Stderr, "refusing to delete stages without -yes (preview with -dry-run)")
+		exit(2)
+	}
+
+	api := conn.connect()
+
+	var packages struct {
+		Results []stagedPackage `json:"results"`
+	}
+
+	if errSR := api.sendReq("GET", "/v1/config/packages", nil, &packages); errSR != nil {
+		fmt.Fprintln(os.Stderr, errSR.Error())
+		exit(1)
+	}
+
+	byName := map[string]stagedPackage{}
+	for _, pkg := range packages.Results {
+		byName[pkg.Name] = pkg
+	}
+
+	now := time.Now()
+
+	for _, name := range packageNames {
+		pkg, ok := byName[name]
+		if !ok {
+			fmt.Fprintf(os.Stderr, "no such package: %s\n", name)
+			exit(1)
+		}
+
+		type datedStage struct {
+			name    string
+			created time.Time
+		}
+
+		var candidates []datedStage
+		for _, stage := range pkg.Stages {
+			if stage == pkg.ActiveStage {
+				continue
+			}
+
+			created, ok := stageTime(stage)
+			if !ok {
+				fmt.Fprintf(os.Stderr, "keeping %s/%s: can't tell its age\n", pkg.Name, stage)
+				continue
+			}
+
+			candidates = append(candidates, datedStage{stage, created})
+		}
+
+		sort.Slice(candidates, func(i, j int) bool {
+			return candidates[i].created.After(candidates[j].created)
+		})
+
+		for i, stage := range candidates {
+			if i < *keep || *retention > 0 && now.Sub(stage.created) < *retention {
+				continue
+			}
+
+			if *dryRun {
+				fmt.Printf("would delete %s/%s\n", pkg.Name, stage.name)
+				continue
+			}
+
+			errSR := api.sendReq(
+				"DELETE", "/v1/config/stages/"+url.PathEscape(pkg.Name)+"/"+url.PathEscape(stage.name),
+				nil, nil,
+			)
+			if errSR != nil {
+				fmt.Fprintln(os.Stderr, errSR.Error())
+				exit(1)
+			}
+
+			fmt.Printf("deleted %s/%s\n", pkg.Name, stage.name)
+		}
+	}
+}
+
+// stageTime extracts the creation time from stage names
+// which Icinga 2 builds as HOSTNAME-UNIXTIME-COUNTER.
+func stageTime(stage string) (time.Time, bool) {
+	parts := strings.Split(stage, "-")
+	if len(parts) < 3 {
+		return time.Time{}, false
+	}
+
+	unix, errPI := strconv.ParseInt(parts[len(parts)-2], 10, 64)
+	if errPI != nil {
+		return time.Time{}, false
+	}
+
+	return time.Unix(unix, 0), true
+}
+
+// newestStage returns the stage created last, judging by stageTime.
+func newestStage(stages []string) string {
+	newest := ""
+	var newestTime time.Time
+
+	for _, stage := range stages {
+		created, _ := stageTime(stage)
+		if newest == "" || created.After(newestTime) || created.Equal(newestTime) && stage > newest {
+			newest, newestTime = stage, created
+		}
+	}
+
+	return newest
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+)
+
+var templateAction = regexp.MustCompile(`\{\{.*?\}\}`)
+
+func outputDir(tmpl, host string, now time.Time) (string, error) {
+	t, errPs := template.New("out").Parse(tmpl)
+	if errPs != nil {
+		return "", errPs
+	}
+
+	buf := &bytes.Buffer{}
+
+	errEx := t.Execute(buf, struct {
+		Time time.Time
+		Host string
+	}{now, host})
+	if errEx != nil {
+		return "", errEx
+	}
+
+	return buf.String(), nil
+}
+
+// safeDirName turns name (e.g. a host) into a directory name without separators,
+// template actions or the like. It's empty if nothing reasonable remains.
+func safeDirName(name string) string {
+	safe := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-', r == '_':
+			return r
+		default:
+			return '_'
+		}
+	}, name)
+
+	if strings.Trim(safe, "._") == "" {
+		return ""
+	}
+
+	return safe
+}
+
+// pruneExports deletes all but the keep newest directories matching tmpl (actions replaced with *) except current.
+// To not delete anything foreign, it only considers directories containing nothing but *.json, *.tar.gz and *.txt files
+// (and -git-attributes' ones) or package directories (-format dir, -all-stages).
+func pruneExports(tmpl, current string, keep int) ([]string, error) {
+	matches, errGl := filepath.Glob(templateAction.ReplaceAllString(tmpl, "*"))
+	if errGl != nil {
+		return nil, errGl
+	}
+
+	type export struct {
+		dir     string
+		modTime time.Time
+	}
+
+	var exports []export
+
+	for _, match := range matches {
+		if filepath.Clean(match) == filepath.Clean(current) {
+			continue
+		}
+
+		info, errSt := os.Stat(match)
+		if errSt != nil {
+			return nil, errSt
+		}
+
+		if !info.IsDir() {
+			continue
+		}
+
+		entries, errRD := ioutil.ReadDir(match)
+		if errRD != nil {
+			return nil, errRD
+		}
+
+		foreign := false
+		for _, entry := range entries {
+			if !ownedEntry(match, entry) {
+				foreign = true
+				break
+			}
+		}
+
+		if foreign {
+			fmt.Fprintf(os.Stderr, "warning: not pruning %s: contains more than exported packages\n", match)
+			continue
+		}
+
+		exports = append(exports, export{match, info.ModTime()})
+	}
+
+	sort.Slice(exports, func(i, j int) bool {
+		return exports[i].modTime.After(exports[j].modTime)
+	})
+
+	var pruned []string
+
+	// The current export counts as the newest one.
+	for i := keep - 1; i < len(exports); i++ {
+		if errRA := os.RemoveAll(exports[i].dir); errRA != nil {
+			return pruned, errRA
+		}
+
+		pruned = append(pruned, exports[i].dir)
+	}
+
+	return pruned, nil
+}
+
+// ownedEntry tells whether entry of the export directory dir looks like written by an export.
+func ownedEntry(dir string, entry os.FileInfo) bool {
+	name := entry.Name()
+
+	if entry.Mode().IsRegular() {
+		return strings.HasSuffix(name, ".json") || strings.HasSuffix(name, ".tar.gz") ||
+			strings.HasSuffix(name, ".txt") || gitFiles[name]
+	}
+
+	if !entry.IsDir() || strings.HasPrefix(name, ".") {
+		return false
+	}
+
+	// PACKAGE/ (-format dir) or PACKAGE/STAGE.json etc. (-all-stages), named by url.PathEscape
+	if unescaped, errPU := url.PathUnescape(name); errPU != nil || url.PathEscape(unescaped) != name {
+		return false
+	}
+
+	// Package contents are arbitrary, but no devices, sockets or the like.
+	errWk := filepath.Walk(filepath.Join(dir, name), func(_ string, info os.FileInfo, errWk error) error {
+		if errWk != nil {
+			return errWk
+		}
+
+		if mode := info.Mode(); !mode.IsRegular() && !mode.IsDir() && mode&os.ModeSymlink == 0 {
+			return errForeign
+		}
+
+		return nil
+	})
+
+	return errWk == nil
+}
+
+var errForeign = errors.New("foreign file")
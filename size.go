@@ -0,0 +1,186 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"text/tabwriter"
+)
+
+type packageSize struct {
+	Package string `json:"package"`
+	Stage   string `json:"stage,omitempty"`
+	Files   int    `json:"files"`
+	Bytes   int64  `json:"bytes"`
+	// files whose size the master didn't tell, not in Bytes
+	Unknown int `json:"unknown"`
+}
+
+// size sums the sizes of the active stages' files from HEAD requests, i.e. without downloading them.
+func size(args []string) {
+	fs := flag.NewFlagSet("size", flag.ExitOnError)
+	conn := addConnFlags(fs)
+	pkgName := fs.String("package", "", "`NAME` of the package to measure (default: all with an active stage)")
+	fileConcurrency := fs.Int("content-max-concurrency-per-package", 1, "`NUMBER` of files to ask for in parallel")
+	output := addOutputFlag(fs)
+
+	fs.Parse(args)
+	conn.validate()
+	validateOutput(*output)
+
+	if *fileConcurrency < 1 {
+		fmt.Fprintln(os.Stderr, "-content-max-concurrency-per-package must be positive")
+		exit(2)
+	}
+
+	api := conn.connect().withLog(ioutil.Discard)
+
+	var packages struct {
+		Results []stagedPackage `json:"results"`
+	}
+
+	if errSR := api.sendReq("GET", "/v1/config/packages", nil, &packages); errSR != nil {
+		fmt.Fprintln(os.Stderr, errSR.Error())
+		exit(1)
+	}
+
+	var jobs []stageJob
+	for _, pkg := range packages.Results {
+		if pkg.Name != "" && pkg.ActiveStage != "" && (*pkgName == "" || pkg.Name == *pkgName) {
+			jobs = append(jobs, stageJob{pkg.Name, pkg.ActiveStage})
+		}
+	}
+
+	if len(jobs) < 1 {
+		if *pkgName != "" {
+			fmt.Fprintf(os.Stderr, "no such package with an active stage: %s\n", *pkgName)
+		} else {
+			fmt.Fprintln(os.Stderr, "no packages with an active stage")
+		}
+
+		exit(1)
+	}
+
+	exp := &exporter{api: api, fileConcurrency: *fileConcurrency}
+	sizes := make([]packageSize, 0, len(jobs))
+	total := packageSize{Package: "total"}
+
+	for _, job := range jobs {
+		ps, errSz := exp.size(job)
+		if errSz != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", job.pkg, errSz.Error())
+			exit(1)
+		}
+
+		sizes = append(sizes, ps)
+		total.Files += ps.Files
+		total.Bytes += ps.Bytes
+		total.Unknown += ps.Unknown
+	}
+
+	if atomic.LoadInt32(&exp.headUnsupported) != 0 {
+		fmt.Fprintln(os.Stderr, "warning: the master doesn't answer HEAD requests, sizes unknown")
+	}
+
+	render(*output, struct {
+		Packages []packageSize `json:"packages"`
+		Total    packageSize   `json:"total"`
+	}{sizes, total}, func(w io.Writer) {
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "PACKAGE\tFILES\tBYTES\tSIZE\tUNKNOWN")
+
+		for _, ps := range append(sizes, total) {
+			fmt.Fprintf(tw, "%s\t%d\t%d\t%s\t%s\n", ps.Package, ps.Files, ps.Bytes, humanBytes(ps.Bytes), unknownFiles(ps.Unknown))
+		}
+
+		tw.Flush()
+	})
+}
+
+// size lists job's files and asks the master for their sizes, but never downloads them.
+func (e *exporter) size(job stageJob) (packageSize, error) {
+	ps := packageSize{Package: job.pkg, Stage: job.stage}
+
+	var files struct {
+		Results []struct {
+			Name string `json:"name"`
+			Type string `json:"type"`
+		} `json:"results"`
+	}
+
+	uri := "/v1/config/stages/" + url.PathEscape(job.pkg) + "/" + url.PathEscape(job.stage)
+	if errSR := e.api.sendReq("GET", uri, nil, &files); errSR != nil {
+		return ps, errSR
+	}
+
+	var names []string
+	for _, file := range files.Results {
+		if file.Type == "file" && strings.Contains(file.Name, "/") {
+			names = append(names, file.Name)
+		}
+	}
+
+	heads := make([]fileHead, len(names))
+	errs := e.eachFile(e.api, ioutil.Discard, names, func(api *apiClient, i int) error {
+		heads[i].size = -1
+		if atomic.LoadInt32(&e.headUnsupported) != 0 {
+			return nil
+		}
+
+		errSR := api.sendReq("HEAD", fileURI(job.pkg, job.stage, names[i], false), nil, &heads[i])
+		if bhs, ok := errSR.(badHttpStatus); ok && (bhs.code == http.StatusNotFound ||
+			bhs.code == http.StatusMethodNotAllowed || bhs.code == http.StatusNotImplemented) {
+			atomic.StoreInt32(&e.headUnsupported, 1)
+			heads[i].size = -1
+			return nil
+		}
+
+		return errSR
+	})
+
+	for i, head := range heads {
+		if errs[i] != nil {
+			return ps, errs[i]
+		}
+
+		ps.Files++
+		if head.size < 0 {
+			ps.Unknown++
+		} else {
+			ps.Bytes += head.size
+		}
+	}
+
+	return ps, nil
+}
+
+// humanBytes formats n like 1.5 MiB.
+func humanBytes(n int64) string {
+	if n < 1024 {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	value := float64(n)
+	unit := 0
+
+	for ; value >= 1024 && unit < 5; unit++ {
+		value /= 1024
+	}
+
+	return fmt.Sprintf("%.1f %ciB", value, "KMGTP"[unit-1])
+}
+
+// unknownFiles leaves the column empty if all sizes are known.
+func unknownFiles(n int) string {
+	if n < 1 {
+		return ""
+	}
+
+	return fmt.Sprint(n)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// partFile matches partPath's file names.
+var partFile = regexp.MustCompile(`\A(.*)\.part[1-9]\d*\.json\z`)
+
+func partPath(path string, n int) string {
+	return fmt.Sprintf("%s.part%d.json", strings.TrimSuffix(path, ".json"), n)
+}
+
+// writeSplitJSON writes bndl to path like writeJSON or, if its content exceeds threshold bytes, into path's .partN.json
+// files of at most threshold bytes each (unless a single file is larger) referenced by path. It removes stale parts.
+func writeSplitJSON(path string, bndl *bundle, threshold int, escapeHTML bool) error {
+	size := 0
+	for _, content := range bndl.Files {
+		size += len(content)
+	}
+
+	written := 0
+
+	if size <= threshold {
+		if errWJ := writeJSON(path, bndl, escapeHTML); errWJ != nil {
+			return errWJ
+		}
+	} else {
+		names := make([]string, 0, len(bndl.Files))
+		for name := range bndl.Files {
+			names = append(names, name)
+		}
+
+		sort.Strings(names)
+
+		index := &bundle{
+			FormatVersion: extendedFormatVersion, Empty: bndl.Empty, Symlinks: bndl.Symlinks, Meta: bndl.Meta,
+			Truncated: bndl.Truncated, Inactive: bndl.Inactive, Encoding: bndl.Encoding,
+		}
+
+		encoded := map[string]bool{}
+		for _, name := range bndl.Base64 {
+			encoded[name] = true
+		}
+
+		var part *bundle
+		partSize := 0
+
+		flush := func() error {
+			written++
+			file := partPath(path, written)
+			index.Parts = append(index.Parts, filepath.Base(file))
+
+			return writeJSON(file, part, escapeHTML)
+		}
+
+		for _, name := range names {
+			content := bndl.Files[name]
+
+			if part != nil && partSize+len(content) > threshold {
+				if errFl := flush(); errFl != nil {
+					return errFl
+				}
+
+				part = nil
+			}
+
+			if part == nil {
+				part = &bundle{FormatVersion: extendedFormatVersion, Files: map[string]string{}, PartOf: filepath.Base(path)}
+				partSize = 0
+			}
+
+			part.Files[name] = content
+			if encoded[name] {
+				part.Base64 = append(part.Base64, name)
+			}
+			partSize += len(content)
+		}
+
+		if errFl := flush(); errFl != nil {
+			return errFl
+		}
+
+		if errWJ := writeJSON(path, index, escapeHTML); errWJ != nil {
+			return errWJ
+		}
+	}
+
+	for n := written + 1; ; n++ {
+		if errRm := os.Remove(partPath(path, n)); errRm != nil {
+			if os.IsNotExist(errRm) {
+				return nil
+			}
+
+			return errRm
+		}
+	}
+}
+
+// joinParts merges the parts referenced by index (read from the directory dir) into it.
+func joinParts(dir string, index *bundle, minVersion int) error {
+	index.Files = map[string]string{}
+
+	for _, name := range index.Parts {
+		if filepath.Base(name) != name {
+			return fmt.Errorf("refusing to read part %s from outside %s", name, dir)
+		}
+
+		part, errRB := readBundle(filepath.Join(dir, name), minVersion)
+		if errRB != nil {
+			return errRB
+		}
+
+		if len(part.Parts) > 0 {
+			return fmt.Errorf("%s: parts must not have parts", name)
+		}
+
+		for file, content := range part.Files {
+			index.Files[file] = content
+		}
+	}
+
+	index.Parts = nil
+	return nil
+}
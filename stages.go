@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+type stageInfo struct {
+	Stage   string `json:"stage"`
+	Active  bool   `json:"active"`
+	Files   int    `json:"files"`
+	Created string `json:"created,omitempty"`
+}
+
+// listStages prints the stages of the package named pkgName among packages with their file counts.
+func listStages(api *apiClient, packages []stagedPackage, pkgName, output string) {
+	var pkg *stagedPackage
+	for i := range packages {
+		if packages[i].Name == pkgName {
+			pkg = &packages[i]
+			break
+		}
+	}
+
+	if pkg == nil {
+		fmt.Fprintf(os.Stderr, "no such package: %s\n", pkgName)
+		exit(1)
+	}
+
+	infos, errSI := stageInfos(api, pkg)
+	if errSI != nil {
+		fmt.Fprintln(os.Stderr, errSI.Error())
+		exit(1)
+	}
+
+	render(output, infos, func(w io.Writer) {
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "STAGE\tACTIVE\tFILES\tCREATED")
+
+		for _, info := range infos {
+			active := ""
+			if info.Active {
+				active = "*"
+			}
+
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%s\n", info.Stage, active, info.Files, info.Created)
+		}
+
+		tw.Flush()
+	})
+}
+
+// stageInfos lists pkg's stages (sorted) with their file counts.
+func stageInfos(api *apiClient, pkg *stagedPackage) ([]stageInfo, error) {
+	stages := append([]string(nil), pkg.Stages...)
+	sort.Strings(stages)
+
+	infos := make([]stageInfo, 0, len(stages))
+
+	for _, stage := range stages {
+		var files struct {
+			Results []struct {
+				Type string `json:"type"`
+			} `json:"results"`
+		}
+
+		uri := "/v1/config/stages/" + url.PathEscape(pkg.Name) + "/" + url.PathEscape(stage)
+		if errSR := api.sendReq("GET", uri, nil, &files); errSR != nil {
+			return nil, errSR
+		}
+
+		info := stageInfo{Stage: stage, Active: stage == pkg.ActiveStage}
+		for _, file := range files.Results {
+			if file.Type == "file" {
+				info.Files++
+			}
+		}
+
+		if created, ok := stageTime(stage); ok {
+			info.Created = created.UTC().Format(time.RFC3339)
+		}
+
+		infos = append(infos, info)
+	}
+
+	return infos, nil
+}
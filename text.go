@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// writeText writes bndl as -format text, see fillText.
+func writeText(path, name string, bndl *bundle) error {
+	return writeFile(path, func(w io.Writer) error {
+		return fillText(w, map[string]*bundle{name: bndl})
+	})
+}
+
+// fillText writes the bundles' files as one document for reading and grepping, not for import:
+// a === PACKAGE/PATH === line per file (sorted) followed by its content.
+func fillText(w io.Writer, bundles map[string]*bundle) error {
+	buf := bufio.NewWriter(w)
+	buf.WriteString("# i2pkg -format text, for reading only - can't be imported\n")
+
+	var names []string
+	for name := range bundles {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		bndl := bundles[name]
+		contents := map[string]string{}
+
+		for file, content := range bndl.Files {
+			contents[file] = content
+		}
+
+		for _, file := range bndl.Empty {
+			contents[file] = ""
+		}
+
+		var files []string
+		for file := range contents {
+			files = append(files, file)
+		}
+
+		for file := range bndl.Symlinks {
+			files = append(files, file)
+		}
+
+		sort.Strings(files)
+
+		for _, file := range files {
+			if target, ok := bndl.Symlinks[file]; ok {
+				fmt.Fprintf(buf, "\n=== %s/%s -> %s ===\n", name, file, target)
+				continue
+			}
+
+			fmt.Fprintf(buf, "\n=== %s/%s ===\n", name, file)
+
+			switch content := contents[file]; {
+			case isBinary(content):
+				fmt.Fprintf(buf, "(binary, %d bytes)\n", len(content))
+			case content == "":
+			case strings.HasSuffix(content, "\n"):
+				buf.WriteString(content)
+			default:
+				buf.WriteString(content)
+				buf.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+	}
+
+	return buf.Flush()
+}
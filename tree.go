@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+type treeModes struct {
+	file os.FileMode
+	dir  os.FileMode
+	// put a .gitkeep into empty directories
+	gitkeep bool
+}
+
+// writeTree replaces the directory dir with one containing bndl's files.
+func writeTree(dir string, bndl *bundle, modes treeModes) error {
+	tmp := fmt.Sprintf("%s.%d.tmp", dir, os.Getpid())
+	if errMA := os.MkdirAll(tmp, modes.dir); errMA != nil {
+		return errMA
+	}
+
+	if errFT := fillTree(tmp, bndl, modes); errFT != nil {
+		os.RemoveAll(tmp)
+		return errFT
+	}
+
+	if errCT := chownTree(tmp); errCT != nil {
+		os.RemoveAll(tmp)
+		return errCT
+	}
+
+	if errRA := os.RemoveAll(dir); errRA != nil {
+		os.RemoveAll(tmp)
+		return errRA
+	}
+
+	return os.Rename(tmp, dir)
+}
+
+func fillTree(root string, bndl *bundle, modes treeModes) error {
+	for name, content := range bndl.Files {
+		if errWF := writeTreeFile(root, name, []byte(content), modes); errWF != nil {
+			return errWF
+		}
+	}
+
+	for _, name := range bndl.Empty {
+		if errWF := writeTreeFile(root, name, nil, modes); errWF != nil {
+			return errWF
+		}
+	}
+
+	for _, name := range bndl.dirs {
+		path, errTP := treePath(root, name)
+		if errTP != nil {
+			return errTP
+		}
+
+		if errMA := os.MkdirAll(path, modes.dir); errMA != nil {
+			return errMA
+		}
+	}
+
+	if modes.gitkeep {
+		for _, name := range bndl.dirs {
+			if errGK := gitkeep(root, name, modes); errGK != nil {
+				return errGK
+			}
+		}
+	}
+
+	links := cleanSymlinks(bndl.Symlinks)
+
+	for name, target := range bndl.Symlinks {
+		path, errTP := treePath(root, name)
+		if errTP != nil {
+			return errTP
+		}
+
+		if !symlinkStaysInside(links, name) {
+			return fmt.Errorf("refusing to create symlink %s -> %s pointing outside the package", name, target)
+		}
+
+		if errMA := os.MkdirAll(filepath.Dir(path), modes.dir); errMA != nil {
+			return errMA
+		}
+
+		if errSl := os.Symlink(target, path); errSl != nil {
+			return errSl
+		}
+	}
+
+	return nil
+}
+
+// gitkeep writes a .gitkeep into root's directory name if that's empty.
+func gitkeep(root, name string, modes treeModes) error {
+	path, _ := treePath(root, name)
+
+	f, errOp := os.Open(path)
+	if errOp != nil {
+		return errOp
+	}
+
+	_, errRd := f.Readdirnames(1)
+	f.Close()
+
+	switch errRd {
+	case nil:
+		return nil
+	case io.EOF:
+		return writeTreeFile(root, name+"/.gitkeep", nil, modes)
+	default:
+		return errRd
+	}
+}
+
+func writeTreeFile(root, name string, content []byte, modes treeModes) error {
+	path, errTP := treePath(root, name)
+	if errTP != nil {
+		return errTP
+	}
+
+	if errMA := os.MkdirAll(filepath.Dir(path), modes.dir); errMA != nil {
+		return errMA
+	}
+
+	f, errOp := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, modes.file)
+	if errOp != nil {
+		return errOp
+	}
+
+	if _, errWr := f.Write(content); errWr != nil {
+		f.Close()
+		return errWr
+	}
+
+	return f.Close()
+}
+
+// treePath maps the bundle entry name to a path under root or refuses to if it would end up elsewhere.
+func treePath(root, name string) (string, error) {
+	path := filepath.Join(root, filepath.FromSlash(name))
+	if !isInside(root, path) || path == filepath.Clean(root) {
+		return "", fmt.Errorf("refusing to write %q outside of %s", name, root)
+	}
+
+	return path, nil
+}
+
+// maxSymlinkHops bounds symlinkStaysInside's resolution of links pointing to links (and loops).
+const maxSymlinkHops = 255
+
+// symlinkStaysInside tells whether the bundle's link name would resolve to somewhere inside the package.
+// It resolves like the OS, i.e. through all of links (bundle names to targets), not just name's own target,
+// so e.g. a/b/c -> .. and a/b/c/d -> ../../.. are refused as a/b/c/d ends up one level above the package.
+func symlinkStaysInside(links map[string]string, name string) bool {
+	name = path.Clean(name)
+	target := links[name]
+	if path.IsAbs(target) {
+		return false
+	}
+
+	pending := append(strings.Split(path.Dir(name), "/"), strings.Split(target, "/")...)
+	var resolved []string
+	hops := 0
+
+	for len(pending) > 0 {
+		component := pending[0]
+		pending = pending[1:]
+
+		switch component {
+		case "", ".":
+			continue
+		case "..":
+			if len(resolved) < 1 {
+				return false
+			}
+
+			resolved = resolved[:len(resolved)-1]
+			continue
+		}
+
+		resolved = append(resolved, component)
+
+		if link, ok := links[strings.Join(resolved, "/")]; ok {
+			if hops++; hops > maxSymlinkHops || path.IsAbs(link) {
+				return false
+			}
+
+			resolved = resolved[:len(resolved)-1]
+			pending = append(strings.Split(link, "/"), pending...)
+		}
+	}
+
+	return true
+}
+
+// cleanSymlinks keys links by their cleaned names for symlinkStaysInside.
+func cleanSymlinks(links map[string]string) map[string]string {
+	cleaned := make(map[string]string, len(links))
+	for name, target := range links {
+		cleaned[path.Clean(name)] = target
+	}
+
+	return cleaned
+}
+
+func isInside(root, path string) bool {
+	rel, errRl := filepath.Rel(filepath.Clean(root), filepath.Clean(path))
+	return errRl == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSymlinkStaysInside(t *testing.T) {
+	cases := []struct {
+		name   string
+		links  map[string]string
+		link   string
+		inside bool
+	}{
+		{"sibling", map[string]string{"a/b": "c"}, "a/b", true},
+		{"up to root", map[string]string{"a/b": ".."}, "a/b", true},
+		{"root itself", map[string]string{"a": "."}, "a", true},
+		{"above root", map[string]string{"a/b": "../.."}, "a/b", false},
+		{"absolute", map[string]string{"a": "/etc"}, "a", false},
+		{"unclean name", map[string]string{"a//b/": "../c"}, "a//b/", true},
+		{"down and up", map[string]string{"a": "b/../../c"}, "a", false},
+		{
+			"below an earlier link", map[string]string{"a/b/c": "..", "a/b/c/d": "../../.."},
+			"a/b/c/d", false,
+		},
+		{
+			"through an upward link", map[string]string{"a/b/c": "../..", "x": "a/b/c/.."},
+			"x", false,
+		},
+		{
+			"through a downward link", map[string]string{"a": "b/c", "x": "a/.."},
+			"x", true,
+		},
+		{"through an absolute link", map[string]string{"a": "/", "x": "a/etc"}, "x", false},
+		{"loop", map[string]string{"a": "b", "b": "a", "x": "a/c"}, "x", false},
+	}
+
+	for _, c := range cases {
+		if inside := symlinkStaysInside(cleanSymlinks(c.links), c.link); inside != c.inside {
+			t.Errorf("%s: symlinkStaysInside(%v, %q) = %v, want %v", c.name, c.links, c.link, inside, c.inside)
+		}
+	}
+}
+
+func TestTreePath(t *testing.T) {
+	cases := []struct {
+		name string
+		ok   bool
+	}{
+		{"conf.d/a.conf", true},
+		{"a/../b", true},
+		{"../a", false},
+		{"a/../../b", false},
+		{".", false},
+		{"a/..", false},
+	}
+
+	for _, c := range cases {
+		if _, errTP := treePath("root", c.name); (errTP == nil) != c.ok {
+			t.Errorf("treePath(%q): %v, want ok = %v", c.name, errTP, c.ok)
+		}
+	}
+}
+
+func TestFillTreeRefusesEscapingSymlinks(t *testing.T) {
+	dir, errTD := ioutil.TempDir("", "i2pkg-test-")
+	if errTD != nil {
+		t.Fatal(errTD)
+	}
+
+	defer os.RemoveAll(dir)
+
+	root := filepath.Join(dir, "root")
+	bndl := &bundle{Symlinks: map[string]string{"a/b/c": "..", "a/b/c/d": "../../.."}}
+
+	if errFT := fillTree(root, bndl, treeModes{file: 0644, dir: 0755}); errFT == nil {
+		t.Error("fillTree accepted a symlink below a symlink escaping the root")
+	}
+
+	if _, errLs := os.Lstat(filepath.Join(dir, "d")); !os.IsNotExist(errLs) {
+		t.Errorf("fillTree created a symlink outside the root: %v", errLs)
+	}
+}
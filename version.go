@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+// versionNumbers finds the major and minor version in e.g. v2.13.2 or r2.12.3-1.
+var versionNumbers = regexp.MustCompile(`(\d+)\.(\d+)`)
+
+// masterVersion asks the master for its Icinga 2 version, e.g. r2.13.2-1.
+func masterVersion(api *apiClient) (string, error) {
+	var status struct {
+		Results []struct {
+			Status struct {
+				IcingaApplication struct {
+					App struct {
+						Version string `json:"version"`
+					} `json:"app"`
+				} `json:"icingaapplication"`
+			} `json:"status"`
+		} `json:"results"`
+	}
+
+	if errSR := api.sendReq("GET", "/v1/status/IcingaApplication", nil, &status); errSR != nil {
+		return "", errSR
+	}
+
+	for _, res := range status.Results {
+		if version := res.Status.IcingaApplication.App.Version; version != "" {
+			return version, nil
+		}
+	}
+
+	return "", fmt.Errorf("the master didn't tell its version")
+}
+
+// versionAtLeast tells whether version is major.minor or newer.
+func versionAtLeast(version string, major, minor int) (bool, error) {
+	match := versionNumbers.FindStringSubmatch(version)
+	if match == nil {
+		return false, fmt.Errorf("bad version %q", version)
+	}
+
+	actualMajor, _ := strconv.Atoi(match[1])
+	actualMinor, _ := strconv.Atoi(match[2])
+
+	return actualMajor > major || actualMajor == major && actualMinor >= minor, nil
+}
+
+// requireInactiveStages fails unless the master honors activate=false (Icinga 2 v2.13+).
+// Older ones activate new stages anyway.
+func requireInactiveStages(api *apiClient, flag string) error {
+	version, errMV := masterVersion(api)
+	if errMV != nil {
+		return fmt.Errorf("%s: can't tell whether the master supports not activating stages: %s", flag, errMV.Error())
+	}
+
+	ok, errVA := versionAtLeast(version, 2, 13)
+	if errVA != nil {
+		return fmt.Errorf("%s: can't tell whether the master supports not activating stages: %s", flag, errVA.Error())
+	}
+
+	if !ok {
+		return fmt.Errorf("%s requires Icinga 2 v2.13+, the master (%s) would activate the stages anyway", flag, version)
+	}
+
+	return nil
+}
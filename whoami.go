@@ -0,0 +1,59 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+)
+
+// apiInfo is what GET /v1 returns.
+type apiInfo struct {
+	Results []struct {
+		Info        string   `json:"info"`
+		Permissions []string `json:"permissions"`
+		User        string   `json:"user"`
+		Version     string   `json:"version"`
+	} `json:"results"`
+}
+
+func whoami(args []string) {
+	fs := flag.NewFlagSet("whoami", flag.ExitOnError)
+	conn := addConnFlags(fs)
+	output := addOutputFlag(fs)
+
+	fs.Parse(args)
+	conn.validate()
+	validateOutput(*output)
+
+	api := conn.connect().withLog(os.Stderr)
+
+	var info apiInfo
+
+	if errSR := api.sendReq("GET", "/v1", nil, &info); errSR != nil {
+		if bhs, ok := errSR.(badHttpStatus); ok && bhs.code == http.StatusNotFound {
+			fmt.Fprintln(os.Stderr, "not supported on this Icinga 2 version")
+		} else {
+			fmt.Fprintln(os.Stderr, errSR.Error())
+		}
+
+		exit(1)
+	}
+
+	if len(info.Results) < 1 {
+		fmt.Fprintln(os.Stderr, "not supported on this Icinga 2 version")
+		exit(1)
+	}
+
+	// Icinga 2 doesn't tell the filters themselves, but marks permissions having one as "(filtered)".
+	render(*output, info.Results, func(w io.Writer) {
+		for _, res := range info.Results {
+			fmt.Fprintf(w, "user: %s\nversion: %s\npermissions:\n", res.User, res.Version)
+
+			for _, perm := range res.Permissions {
+				fmt.Fprintf(w, "  %s\n", perm)
+			}
+		}
+	})
+}